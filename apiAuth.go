@@ -0,0 +1,123 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// What an API call is allowed to do.
+type apiRole int
+
+const (
+	roleNone  apiRole = iota // no API access
+	roleSelf                 // only the session of the caller
+	roleAdmin                // every session and the shared profiles
+)
+
+type apiToken struct {
+	token string
+	role  apiRole
+}
+
+// nil if the API does not use tokens.
+var apiTokens []apiToken
+
+// loadAPITokens reads a file with one role:token per line, the role is self
+// or admin. Empty lines and lines starting with # are skipped.
+func loadAPITokens(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tokens := []apiToken{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		roleAndToken := strings.SplitN(line, ":", 2)
+		if len(roleAndToken) != 2 || roleAndToken[1] == "" {
+			return errors.New(path + ":" + strconv.Itoa(lineNumber) + ": expected role:token")
+		}
+		token := apiToken{token: roleAndToken[1]}
+		switch roleAndToken[0] {
+		case "self":
+			token.role = roleSelf
+		case "admin":
+			token.role = roleAdmin
+		default:
+			return errors.New(path + ":" + strconv.Itoa(lineNumber) + ": role must be self or admin")
+		}
+		tokens = append(tokens, token)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	apiTokens = tokens
+	return nil
+}
+
+// requestToken returns the token of req, from "Authorization: Bearer token"
+// or the X-Proxy-Token header.
+func requestToken(req *http.Request) string {
+	if token := req.Header.Get("X-Proxy-Token"); token != "" {
+		return token
+	}
+	auth := req.Header.Get("Authorization")
+	if len(auth) > len("bearer ") && strings.EqualFold(auth[:len("bearer ")], "bearer ") {
+		return strings.TrimSpace(auth[len("bearer "):])
+	}
+	return ""
+}
+
+// tokenRole returns the role of the token of req, roleNone if it has none
+// or an unknown one.
+func tokenRole(req *http.Request) apiRole {
+	token := requestToken(req)
+	role := roleNone
+	if token == "" {
+		return role
+	}
+	for _, known := range apiTokens {
+		if subtle.ConstantTimeCompare([]byte(known.token), []byte(token)) == 1 {
+			role = known.role
+		}
+	}
+	return role
+}
+
+// requestRole returns what an API call is allowed to do. Without tokens the
+// API is open as it always was, except that logged in users only get their
+// own session.
+func requestRole(req *http.Request) apiRole {
+	if apiTokens != nil {
+		return tokenRole(req)
+	}
+	if proxyAuth != nil {
+		return roleSelf
+	}
+	return roleAdmin
+}
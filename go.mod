@@ -1,5 +1,5 @@
 module restfulHttpsProxy
 
-go 1.12
+go 1.14
 
 require github.com/dsnet/compress v0.0.1
@@ -0,0 +1,314 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAR 1.2, see http://www.softwareishard.com/blog/har-12-spec/
+// Fields starting with an underscore are custom fields, which the spec allows.
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+
+	// The request as it was sent upstream and the response as the upstream
+	// sent it, before the rewrite rules touched them.
+	RewrittenRequest *harRequest  `json:"_rewrittenRequest,omitempty"`
+	OriginalResponse *harResponse `json:"_originalResponse,omitempty"`
+
+	// Why the client got no response, the response then has status 0.
+	Error string `json:"_error,omitempty"`
+
+	// Like Chrome exports WebSockets.
+	ResourceType      string                `json:"_resourceType,omitempty"`
+	WebSocketMessages []harWebSocketMessage `json:"_webSocketMessages,omitempty"`
+}
+
+type harWebSocketMessage struct {
+	Type   string  `json:"type"` // send or receive, as seen by the client
+	Time   float64 `json:"time"` // seconds since the epoch
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type har struct {
+	Log harLog `json:"log"`
+}
+
+// getHarLogs returns the log of ip as a HAR document.
+func getHarLogs(ip string) ([]byte, error) {
+	logs := getLogs(ip)
+	logBytes, err := ioutil.ReadAll(logs)
+	logs.Close()
+	if err != nil {
+		return nil, err
+	}
+	var roundTrips []roundTripLog
+	if err := json.Unmarshal(logBytes, &roundTrips); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(toHar(roundTrips)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func toHar(roundTrips []roundTripLog) har {
+	h := har{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "restfulHttpsProxy", Version: "1.0"},
+			Entries: []harEntry{},
+		},
+	}
+	for _, rt := range roundTrips {
+		h.Log.Entries = append(h.Log.Entries, toHarEntry(rt))
+	}
+	return h
+}
+
+func toHarEntry(rt roundTripLog) harEntry {
+	entry := harEntry{
+		StartedDateTime: time.Unix(0, rt.Req.Timestamp*int64(time.Millisecond)).Format("2006-01-02T15:04:05.000Z07:00"),
+		Request:         toHarRequest(rt.Req),
+		Response:        toHarResponse(rt.Resp),
+		Timings:         toHarTimings(rt.Timings),
+		Error:           rt.Error,
+	}
+	t := entry.Timings
+	entry.Time = t.Send + t.Wait + t.Receive
+	for _, phase := range []float64{t.DNS, t.Connect} {
+		if phase > 0 {
+			entry.Time += phase
+		}
+	}
+	if rt.RewrittenReq.Method != "" {
+		rewrittenReq := toHarRequest(rt.RewrittenReq)
+		entry.RewrittenRequest = &rewrittenReq
+	}
+	if rt.OriginalResp.Status != "" {
+		originalResp := toHarResponse(rt.OriginalResp)
+		entry.OriginalResponse = &originalResp
+	}
+	if rt.WebSocketMessages != nil {
+		entry.ResourceType = "websocket"
+		entry.WebSocketMessages = toHarWebSocketMessages(rt.WebSocketMessages)
+	}
+	return entry
+}
+
+// toHarWebSocketMessages returns the messages as the client saw them: what
+// it sent before the rules and what it received after them.
+func toHarWebSocketMessages(messages []webSocketMessageLog) []harWebSocketMessage {
+	harMessages := []harWebSocketMessage{}
+	for _, m := range messages {
+		harMessage := harWebSocketMessage{
+			Type:   "receive",
+			Time:   float64(m.Timestamp) / 1000,
+			Opcode: 1,
+			Data:   m.Data,
+		}
+		if m.FromClient {
+			if m.Injected {
+				continue
+			}
+			harMessage.Type = "send"
+			if m.Original != nil {
+				harMessage.Data = *m.Original
+			}
+		} else if m.Dropped {
+			continue
+		}
+		if m.Binary {
+			harMessage.Opcode = 2
+		}
+		harMessages = append(harMessages, harMessage)
+	}
+	return harMessages
+}
+
+func toHarRequest(l requestLog) harRequest {
+	req := harRequest{
+		Method:      l.Method,
+		URL:         l.URL,
+		HTTPVersion: l.HTTPVersion,
+		Cookies:     []harNameValue{},
+		Headers:     headerStringToHar(l.Headers),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    l.BodySize,
+	}
+	if u, err := url.Parse(l.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				req.QueryString = append(req.QueryString, harNameValue{Name: name, Value: value})
+			}
+		}
+	}
+	if l.BodySize > 0 {
+		req.PostData = &harPostData{
+			MimeType: harHeaderValue(req.Headers, "Content-Type"),
+			Text:     l.Body,
+			Encoding: l.BodyEncoding,
+		}
+	}
+	return req
+}
+
+func toHarResponse(l responseLog) harResponse {
+	resp := harResponse{
+		HTTPVersion: l.HTTPVersion,
+		Cookies:     []harNameValue{},
+		Headers:     headerStringToHar(l.Headers),
+		HeadersSize: -1,
+		BodySize:    l.BodySize,
+	}
+	s := strings.SplitN(l.Status, " ", 2)
+	resp.Status, _ = strconv.Atoi(s[0])
+	if len(s) == 2 {
+		resp.StatusText = s[1]
+	}
+	resp.Content = harContent{
+		Size:     l.BodySize,
+		MimeType: harHeaderValue(resp.Headers, "Content-Type"),
+		Text:     l.Body,
+		Encoding: l.BodyEncoding,
+	}
+	resp.RedirectURL = harHeaderValue(resp.Headers, "Location")
+	return resp
+}
+
+// In HAR the ssl time is also counted in connect.
+func toHarTimings(l timingsLog) harTimings {
+	t := harTimings{
+		Blocked: -1,
+		DNS:     l.DNS,
+		Connect: l.Connect,
+		Send:    l.Send,
+		Wait:    l.Wait,
+		Receive: l.Receive,
+		SSL:     l.SSL,
+	}
+	if t.Connect >= 0 && t.SSL >= 0 {
+		t.Connect += t.SSL
+	}
+	return t
+}
+
+// headerStringToHar parses a header string as written by headerToString.
+func headerStringToHar(headers string) []harNameValue {
+	nameValues := []harNameValue{}
+	for _, line := range strings.Split(headers, "\r\n") {
+		s := strings.SplitN(line, ":", 2)
+		if len(s) != 2 {
+			continue
+		}
+		nameValues = append(nameValues, harNameValue{
+			Name:  s[0],
+			Value: strings.TrimSpace(s[1]),
+		})
+	}
+	return nameValues
+}
+
+func harHeaderValue(headers []harNameValue, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestToHarEntry(t *testing.T) {
+	rt := roundTripLog{
+		Req: requestLog{
+			Method:      "POST",
+			URL:         "https://example.com/a?q=1&q=2",
+			HTTPVersion: "HTTP/1.1",
+			Headers:     "Content-Type: text/plain\r\nX-A: b",
+			Body:        "hi",
+			BodySize:    2,
+			Timestamp:   1600000000123,
+		},
+		RewrittenReq: requestLog{Method: "POST", URL: "https://example.org/a", HTTPVersion: "HTTP/1.1"},
+		OriginalResp: responseLog{Status: "200 OK", HTTPVersion: "HTTP/1.1", Body: "original"},
+		Resp: responseLog{
+			Status:      "302 Found",
+			HTTPVersion: "HTTP/1.1",
+			Headers:     "Location: https://example.com/b\r\nContent-Type: text/html",
+			Body:        "moved",
+			BodySize:    5,
+		},
+		Timings: timingsLog{DNS: 1, Connect: 2, SSL: 3, Send: 4, Wait: 5, Receive: 6},
+	}
+	entry := toHarEntry(rt)
+
+	started, err := time.Parse("2006-01-02T15:04:05.000Z07:00", entry.StartedDateTime)
+	if err != nil || started.UnixNano()/int64(time.Millisecond) != rt.Req.Timestamp {
+		t.Errorf("got startedDateTime %s", entry.StartedDateTime)
+	}
+	// The ssl time is part of connect in HAR.
+	wantTimings := harTimings{Blocked: -1, DNS: 1, Connect: 5, Send: 4, Wait: 5, Receive: 6, SSL: 3}
+	if entry.Timings != wantTimings || entry.Time != 21 {
+		t.Errorf("got timings %+v and time %v, want %+v and 21", entry.Timings, entry.Time, wantTimings)
+	}
+	req := entry.Request
+	wantQuery := []harNameValue{{"q", "1"}, {"q", "2"}}
+	if req.Method != "POST" || !reflect.DeepEqual(req.QueryString, wantQuery) || len(req.Headers) != 2 {
+		t.Errorf("got request %+v", req)
+	}
+	if req.PostData == nil || req.PostData.Text != "hi" || req.PostData.MimeType != "text/plain" {
+		t.Errorf("got post data %+v", req.PostData)
+	}
+	resp := entry.Response
+	if resp.Status != 302 || resp.StatusText != "Found" || resp.RedirectURL != "https://example.com/b" ||
+		resp.Content.Text != "moved" || resp.Content.MimeType != "text/html" {
+		t.Errorf("got response %+v", resp)
+	}
+	if entry.RewrittenRequest == nil || entry.RewrittenRequest.URL != "https://example.org/a" {
+		t.Errorf("got rewritten request %+v", entry.RewrittenRequest)
+	}
+	if entry.OriginalResponse == nil || entry.OriginalResponse.Status != 200 || entry.OriginalResponse.Content.Text != "original" {
+		t.Errorf("got original response %+v", entry.OriginalResponse)
+	}
+	if entry.ResourceType != "" || entry.WebSocketMessages != nil {
+		t.Errorf("a round trip without WebSocket got resource type %q", entry.ResourceType)
+	}
+
+	// A reused connection, the rules did not change anything.
+	rt.RewrittenReq = requestLog{}
+	rt.OriginalResp = responseLog{}
+	rt.Timings = timingsLog{DNS: -1, Connect: -1, SSL: -1, Send: 4, Wait: 5, Receive: 6}
+	entry = toHarEntry(rt)
+	if entry.Timings.Connect != -1 || entry.Time != 15 {
+		t.Errorf("got timings %+v and time %v for a reused connection", entry.Timings, entry.Time)
+	}
+	if entry.RewrittenRequest != nil || entry.OriginalResponse != nil {
+		t.Error("got rewritten entries for a round trip the rules did not change")
+	}
+}
+
+func TestToHarWebSocketMessages(t *testing.T) {
+	original := "HELLO"
+	rt := roundTripLog{
+		Req:  requestLog{Method: "GET", URL: "wss://example.com/ws", Timestamp: 1600000000000},
+		Resp: responseLog{Status: "101 Switching Protocols"},
+		WebSocketMessages: []webSocketMessageLog{
+			{FromClient: true, Data: "hello", Original: &original, Timestamp: 1600000000100},
+			{FromClient: true, Data: "injected to the server", Injected: true, Timestamp: 1600000000200},
+			{Data: "hi", Timestamp: 1600000000300},
+			{Data: "dropped by a rule", Dropped: true, Timestamp: 1600000000400},
+			{Data: "injected to the client", Injected: true, Timestamp: 1600000000500},
+			{FromClient: true, Data: "bye", Dropped: true, Timestamp: 1600000000600},
+			{Binary: true, Data: "AAE=", DataEncoding: "base64", Timestamp: 1600000000700},
+		},
+	}
+	entry := toHarEntry(rt)
+	if entry.ResourceType != "websocket" {
+		t.Errorf("got resource type %q, want websocket", entry.ResourceType)
+	}
+	// As the client saw them, what it sent before the rules and what it got after them.
+	want := []harWebSocketMessage{
+		{Type: "send", Time: 1600000000.1, Opcode: 1, Data: "HELLO"},
+		{Type: "receive", Time: 1600000000.3, Opcode: 1, Data: "hi"},
+		{Type: "receive", Time: 1600000000.5, Opcode: 1, Data: "injected to the client"},
+		{Type: "send", Time: 1600000000.6, Opcode: 1, Data: "bye"},
+		{Type: "receive", Time: 1600000000.7, Opcode: 2, Data: "AAE="},
+	}
+	if !reflect.DeepEqual(entry.WebSocketMessages, want) {
+		t.Errorf("got messages %+v, want %+v", entry.WebSocketMessages, want)
+	}
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonPath
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Only a subset of JSONPath is supported:
+// $ the root, .name and ['name'] object members, [0] array elements,
+// .* and [*] every member or element.
+// JSON Pointers (RFC 6901) are parsed into the same kind of path.
+
+type step struct {
+	key      string
+	index    int // -1 if key is not an array index
+	wildcard bool
+}
+
+func keyStep(key string) step {
+	index, err := strconv.Atoi(key)
+	if err != nil || index < 0 || (len(key) > 1 && key[0] == '0') {
+		index = -1
+	}
+	return step{key: key, index: index}
+}
+
+type Path struct {
+	src   string
+	steps []step
+}
+
+func (p *Path) String() string {
+	return p.src
+}
+
+// Parse parses a JSONPath, or a JSON Pointer if src does not start with $.
+func Parse(src string) (*Path, error) {
+	if src == "" || src[0] == '/' {
+		return ParsePointer(src)
+	}
+	p := &Path{src: src}
+	if !strings.HasPrefix(src, "$") {
+		return nil, errors.New("JSONPath must start with $: " + src)
+	}
+	s := src[1:]
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			s = s[1:]
+			end := strings.IndexAny(s, ".[")
+			if end == -1 {
+				end = len(s)
+			}
+			name := s[:end]
+			s = s[end:]
+			if name == "" {
+				return nil, errors.New("Empty member name in JSONPath: " + src)
+			}
+			if name == "*" {
+				p.steps = append(p.steps, step{wildcard: true})
+			} else {
+				p.steps = append(p.steps, keyStep(name))
+			}
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end == -1 {
+				return nil, errors.New("Missing ] in JSONPath: " + src)
+			}
+			inner := s[1:end]
+			s = s[end+1:]
+			if inner == "*" {
+				p.steps = append(p.steps, step{wildcard: true})
+			} else if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				p.steps = append(p.steps, keyStep(inner[1:len(inner)-1]))
+			} else {
+				st := keyStep(inner)
+				if st.index == -1 {
+					return nil, errors.New("Illegal index in JSONPath: " + src)
+				}
+				p.steps = append(p.steps, st)
+			}
+		default:
+			return nil, errors.New("Unexpected character in JSONPath: " + src)
+		}
+	}
+	return p, nil
+}
+
+// ParsePointer parses a JSON Pointer like /user/roles/0.
+func ParsePointer(src string) (*Path, error) {
+	p := &Path{src: src}
+	if src == "" {
+		return p, nil
+	}
+	if src[0] != '/' {
+		return nil, errors.New("JSON Pointer must start with /: " + src)
+	}
+	for _, token := range strings.Split(src[1:], "/") {
+		token = strings.Replace(token, "~1", "/", -1)
+		token = strings.Replace(token, "~0", "~", -1)
+		p.steps = append(p.steps, keyStep(token))
+	}
+	return p, nil
+}
+
+// Decode decodes JSON keeping numbers as json.Number, so that they are
+// written back exactly as they were.
+func Decode(b []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("Trailing data after JSON value")
+	}
+	return doc, nil
+}
+
+// Get returns every value in doc that the path points to. doc is a value
+// as decoded by encoding/json into an interface{}.
+func (p *Path) Get(doc interface{}) []interface{} {
+	values := []interface{}{doc}
+	for _, st := range p.steps {
+		var next []interface{}
+		for _, value := range values {
+			next = append(next, st.children(value)...)
+		}
+		values = next
+	}
+	return values
+}
+
+func (st step) children(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if st.wildcard {
+			var children []interface{}
+			for _, child := range v {
+				children = append(children, child)
+			}
+			return children
+		}
+		if child, ok := v[st.key]; ok {
+			return []interface{}{child}
+		}
+	case []interface{}:
+		if st.wildcard {
+			return v
+		}
+		if st.index >= 0 && st.index < len(v) {
+			return []interface{}{v[st.index]}
+		}
+	}
+	return nil
+}
+
+// Set sets value everywhere the path points to and returns the new doc.
+// Missing object members are created, array elements are replaced.
+func (p *Path) Set(doc interface{}, value interface{}) (interface{}, error) {
+	return p.set(doc, p.steps, value, false)
+}
+
+// Add is like Set, but inserts into arrays as the JSON Patch add operation
+// does. The key - appends to an array.
+func (p *Path) Add(doc interface{}, value interface{}) (interface{}, error) {
+	return p.set(doc, p.steps, value, true)
+}
+
+func (p *Path) set(node interface{}, steps []step, value interface{}, insert bool) (interface{}, error) {
+	if len(steps) == 0 {
+		return value, nil
+	}
+	st := steps[0]
+	last := len(steps) == 1
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if st.wildcard {
+			for key, child := range v {
+				newChild, err := p.set(child, steps[1:], value, insert)
+				if err != nil {
+					return nil, err
+				}
+				v[key] = newChild
+			}
+			return v, nil
+		}
+		child, ok := v[st.key]
+		if !ok && !last {
+			child = map[string]interface{}{}
+		}
+		newChild, err := p.set(child, steps[1:], value, insert)
+		if err != nil {
+			return nil, err
+		}
+		v[st.key] = newChild
+		return v, nil
+	case []interface{}:
+		if st.wildcard {
+			for i, child := range v {
+				newChild, err := p.set(child, steps[1:], value, insert)
+				if err != nil {
+					return nil, err
+				}
+				v[i] = newChild
+			}
+			return v, nil
+		}
+		if last && st.key == "-" {
+			return append(v, value), nil
+		}
+		if last && insert && st.index == len(v) {
+			return append(v, value), nil
+		}
+		if st.index < 0 || st.index >= len(v) {
+			return nil, errors.New("Index out of range at " + p.src)
+		}
+		if last && insert {
+			v = append(v, nil)
+			copy(v[st.index+1:], v[st.index:])
+			v[st.index] = value
+			return v, nil
+		}
+		newChild, err := p.set(v[st.index], steps[1:], value, insert)
+		if err != nil {
+			return nil, err
+		}
+		v[st.index] = newChild
+		return v, nil
+	}
+	return nil, errors.New("Not an object or array at " + p.src)
+}
+
+// Delete removes everything the path points to and returns the new doc.
+// It fails if nothing was there.
+func (p *Path) Delete(doc interface{}) (interface{}, error) {
+	if len(p.steps) == 0 {
+		return nil, errors.New("Cannot delete the root")
+	}
+	return p.delete(doc, p.steps)
+}
+
+func (p *Path) delete(node interface{}, steps []step) (interface{}, error) {
+	st := steps[0]
+	last := len(steps) == 1
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if st.wildcard {
+			for key, child := range v {
+				if last {
+					delete(v, key)
+					continue
+				}
+				newChild, err := p.delete(child, steps[1:])
+				if err != nil {
+					return nil, err
+				}
+				v[key] = newChild
+			}
+			return v, nil
+		}
+		child, ok := v[st.key]
+		if !ok {
+			return nil, errors.New("Nothing to delete at " + p.src)
+		}
+		if last {
+			delete(v, st.key)
+			return v, nil
+		}
+		newChild, err := p.delete(child, steps[1:])
+		if err != nil {
+			return nil, err
+		}
+		v[st.key] = newChild
+		return v, nil
+	case []interface{}:
+		if st.wildcard {
+			if last {
+				return []interface{}{}, nil
+			}
+			for i, child := range v {
+				newChild, err := p.delete(child, steps[1:])
+				if err != nil {
+					return nil, err
+				}
+				v[i] = newChild
+			}
+			return v, nil
+		}
+		if st.index < 0 || st.index >= len(v) {
+			return nil, errors.New("Nothing to delete at " + p.src)
+		}
+		if last {
+			return append(v[:st.index], v[st.index+1:]...), nil
+		}
+		newChild, err := p.delete(v[st.index], steps[1:])
+		if err != nil {
+			return nil, err
+		}
+		v[st.index] = newChild
+		return v, nil
+	}
+	return nil, errors.New("Nothing to delete at " + p.src)
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonPath
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testDoc = `{"user": {"name": "sam", "roles": ["admin", "dev"]}, "a.b": 1}`
+
+func TestGet(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(testDoc), &doc); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want []interface{}
+	}{
+		{"$.user.name", []interface{}{"sam"}},
+		{"$['user']['roles'][1]", []interface{}{"dev"}},
+		{"$.user.roles[*]", []interface{}{"admin", "dev"}},
+		{"$['a.b']", []interface{}{float64(1)}},
+		{"$.user.missing", nil},
+		{"$.user.roles[5]", nil},
+	}
+	for _, test := range tests {
+		p, err := Parse(test.path)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", test.path, err)
+		}
+		if got := p.Get(doc); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Get(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, path := range []string{"user.name", "$.", "$[1", "$[-1]", "$x"} {
+		if _, err := Parse(path); err == nil {
+			t.Errorf("Parse(%q) did not fail", path)
+		}
+	}
+}
+
+func TestSetAndDelete(t *testing.T) {
+	tests := []struct {
+		path string
+		op   func(p *Path, doc interface{}) (interface{}, error)
+		want string
+	}{
+		{"$.user.name", func(p *Path, doc interface{}) (interface{}, error) { return p.Set(doc, "bob") },
+			`{"a.b":1,"user":{"name":"bob","roles":["admin","dev"]}}`},
+		{"$.user.new.deep", func(p *Path, doc interface{}) (interface{}, error) { return p.Set(doc, true) },
+			`{"a.b":1,"user":{"name":"sam","new":{"deep":true},"roles":["admin","dev"]}}`},
+		{"/user/roles/1", func(p *Path, doc interface{}) (interface{}, error) { return p.Add(doc, "qa") },
+			`{"a.b":1,"user":{"name":"sam","roles":["admin","qa","dev"]}}`},
+		{"/user/roles/-", func(p *Path, doc interface{}) (interface{}, error) { return p.Add(doc, "qa") },
+			`{"a.b":1,"user":{"name":"sam","roles":["admin","dev","qa"]}}`},
+		{"$.user.roles[0]", (*Path).Delete,
+			`{"a.b":1,"user":{"name":"sam","roles":["dev"]}}`},
+		{"/a.b", (*Path).Delete,
+			`{"user":{"name":"sam","roles":["admin","dev"]}}`},
+	}
+	for _, test := range tests {
+		doc, err := Decode([]byte(testDoc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := Parse(test.path)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", test.path, err)
+		}
+		doc, err = test.op(p, doc)
+		if err != nil {
+			t.Fatalf("%q failed: %v", test.path, err)
+		}
+		if got, _ := json.Marshal(doc); string(got) != test.want {
+			t.Errorf("%q gave %s, want %s", test.path, got, test.want)
+		}
+	}
+}
+
+func TestDeleteMissing(t *testing.T) {
+	doc, _ := Decode([]byte(testDoc))
+	p, _ := Parse("$.user.missing")
+	if _, err := p.Delete(doc); err == nil {
+		t.Errorf("Delete of a missing member did not fail")
+	}
+}
@@ -20,93 +20,361 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
-	"os"
+	"path/filepath"
+	"restfulHttpsProxy/metrics"
 	"restfulHttpsProxy/proxy"
 	"restfulHttpsProxy/prxConfig"
-	"restfulHttpsProxy/rewriteLogic"
 	"restfulHttpsProxy/throttle"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const regexBufferSize = 4096 * 4
 
+// Only this much of a request body is looked at when matching rules.
+const maxMatchedBodySize = 1 << 20
+
+// peekBody reads up to limit bytes from body, the returned body still reads
+// the whole thing.
+func peekBody(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser) {
+	if body == nil {
+		return nil, nil
+	}
+	peeked, _ := ioutil.ReadAll(io.LimitReader(body, limit))
+	return peeked, proxy.NewReadDoubleCloser(
+		ioutil.NopCloser(io.MultiReader(bytes.NewReader(peeked), body)),
+		body,
+	)
+}
+
 func setBodyString(resp *http.Response, s string) {
 	buf := bytes.NewBufferString(s)
 	resp.ContentLength = int64(buf.Len())
 	resp.Body = ioutil.NopCloser(buf)
 }
 
-func handleProxyAPI(req *http.Request) *http.Response {
-	clientIP, _ := proxy.SplitHostAndPort(req.RemoteAddr)
+// bufferBody reads the whole body into memory, so that its length is known.
+func bufferBody(body io.ReadCloser) (io.ReadCloser, int64) {
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		log.Print(err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data))
+}
+
+// The files of respond rules are read from this directory, so that clients
+// that can set rules cannot read anything else on the machine.
+var responseDir = "responses"
+
+// mockResponse builds the canned response of respond for req.
+func mockResponse(req *http.Request, respond *prxConfig.Respond) (*http.Response, error) {
+	body := respond.Body
+	if respond.File != "" {
+		var err error
+		body, err = ioutil.ReadFile(filepath.Join(responseDir, respond.File))
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp := proxy.NewResponse(req)
+	resp.StatusCode = respond.Status
+	resp.Status = strconv.Itoa(respond.Status) + " " + http.StatusText(respond.Status)
+	for key, values := range respond.Header {
+		resp.Header[key] = append([]string(nil), values...)
+	}
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// setErrorBody puts err in resp, as JSON if it is a *prxConfig.ConfigError,
+// so that tools can find the wrong place in the rules.
+func setErrorBody(resp *http.Response, err error) {
+	if configErr, ok := err.(*prxConfig.ConfigError); ok {
+		errBytes, _ := json.Marshal(configErr)
+		setBodyString(resp, string(errBytes))
+		resp.Header.Set("Content-Type", "application/json")
+		return
+	}
+	setBodyString(resp, err.Error())
+}
+
+func handleProxyAPI(req *http.Request, session string) *http.Response {
 	resp := proxy.NewResponse(req)
 	errResp := proxy.NewResponse(req)
 	errResp.StatusCode = 404
 	setBodyString(errResp, "")
-	if req.URL.Path == "/api/rules/set" {
+	query := req.URL.Query()
+	role := requestRole(req)
+	if role == roleNone && req.URL.Path != "/ca.pem" && req.URL.Path != "/" {
+		errResp.StatusCode = http.StatusUnauthorized
+		setBodyString(errResp, "A valid API token is needed")
+		return errResp
+	}
+	forbidden := func(message string) *http.Response {
+		if role != roleAdmin && apiTokens == nil {
+			// Logged in users are never admins, only tokens are.
+			message += ", with -auth that needs an admin token of -tokens"
+		}
+		errResp.StatusCode = http.StatusForbidden
+		setBodyString(errResp, message)
+		return errResp
+	}
+	// Admins can use another session with the session parameter, ip is the
+	// older name of it.
+	targetSession := session
+	if query.Get("session") != "" {
+		targetSession = query.Get("session")
+	} else if query.Get("ip") != "" {
+		targetSession = query.Get("ip")
+	}
+	if targetSession != session && role != roleAdmin {
+		return forbidden("Only admins can use other sessions")
+	}
+	if req.URL.Path == "/api/schema" {
+		schemaBytes, _ := json.MarshalIndent(prxConfig.Schema(), "", "\t")
+		setBodyString(resp, string(schemaBytes))
+		resp.Header.Set("Content-Type", "application/schema+json")
+	} else if req.URL.Path == "/api/rules" {
+		configBytes, _ := json.Marshal(getRules(targetSession))
+		setBodyString(resp, string(configBytes))
+		resp.Header.Set("Content-Type", "application/json")
+	} else if req.URL.Path == "/api/rules/add" {
+		entryBytes, err := ioutil.ReadAll(req.Body)
+		var entry prxConfig.EntryJSON
+		if err == nil {
+			entry, err = prxConfig.ParseEntry(entryBytes)
+		}
+		if err != nil {
+			setErrorBody(errResp, err)
+			return errResp
+		}
+		index := -1
+		if query.Get("index") != "" {
+			index, err = strconv.Atoi(query.Get("index"))
+			if err != nil {
+				setErrorBody(errResp, err)
+				return errResp
+			}
+		}
+		id, err := addRule(targetSession, entry, index)
+		if err != nil {
+			setErrorBody(errResp, err)
+			return errResp
+		}
+		idBytes, _ := json.Marshal(map[string]string{"id": id})
+		setBodyString(resp, string(idBytes))
+		resp.Header.Set("Content-Type", "application/json")
+	} else if req.URL.Path == "/api/rules/test" {
+		var test ruleTest
+		var result *ruleTestResult
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&test)
+		if err == nil {
+			result, err = testRules(test, targetSession)
+		}
+		if err != nil {
+			setErrorBody(errResp, err)
+			return errResp
+		}
+		resultBytes, _ := json.Marshal(result)
+		setBodyString(resp, string(resultBytes))
+		resp.Header.Set("Content-Type", "application/json")
+	} else if req.URL.Path == "/api/rules/update" {
+		patch, err := ioutil.ReadAll(req.Body)
+		if err == nil {
+			err = patchRule(targetSession, query.Get("id"), patch)
+		}
+		if err != nil {
+			setErrorBody(errResp, err)
+			return errResp
+		}
+		setBodyString(resp, "updating rule")
+	} else if req.URL.Path == "/api/rules/enable" || req.URL.Path == "/api/rules/disable" {
+		err := setRuleDisabled(targetSession, query.Get("id"), req.URL.Path == "/api/rules/disable")
+		if err != nil {
+			setErrorBody(errResp, err)
+			return errResp
+		}
+		setBodyString(resp, strings.TrimPrefix(req.URL.Path, "/api/rules/")+"d rule")
+	} else if req.URL.Path == "/api/rules/delete" {
+		err := deleteRule(targetSession, query.Get("id"))
+		if err != nil {
+			setErrorBody(errResp, err)
+			return errResp
+		}
+		setBodyString(resp, "deleting rule")
+	} else if req.URL.Path == "/api/rules/set" {
 		newRulesBytes, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			setBodyString(errResp, err.Error())
+			setErrorBody(errResp, err)
 			return errResp
 		}
 
 		if newRulesBytes != nil {
-			var config prxConfig.Config
-			err = json.Unmarshal(newRulesBytes, &config)
+			config, err := prxConfig.ParseConfig(newRulesBytes)
 			if err != nil {
-				setBodyString(errResp, err.Error())
+				setErrorBody(errResp, err)
 				return errResp
 			}
-			if config.IP != nil {
-				clientIP = *config.IP
+			configSession := targetSession
+			if config.Session != nil {
+				configSession = *config.Session
+			} else if config.IP != nil {
+				configSession = *config.IP
+			}
+			if configSession != session && role != roleAdmin {
+				return forbidden("Only admins can use other sessions")
 			}
-			newRewriteRules, err := prxConfig.Compile(config)
+			err = setRules(configSession, config)
 			if err != nil {
-				setBodyString(errResp, err.Error())
+				setErrorBody(errResp, err)
 				return errResp
 			}
-			if newRewriteRules != nil {
-				rewriteRules.Store(clientIP, newRewriteRules)
-			} else {
-				rewriteRules.Delete(clientIP)
-			}
-
-			throttledConnections.Delete(clientIP)
 		}
 
 		buf := bytes.NewBufferString("setting rules")
 		resp.ContentLength = int64(buf.Len())
 		resp.Body = ioutil.NopCloser(buf)
 	} else if req.URL.Path == "/api/rules/clear" {
-		rewriteRules.Delete(clientIP)
-		throttledConnections.Delete(clientIP)
+		if err := setRules(targetSession, prxConfig.Config{}); err != nil {
+			errResp.StatusCode = http.StatusInternalServerError
+			setErrorBody(errResp, err)
+			return errResp
+		}
 
 		buf := bytes.NewBufferString("clearing rules")
 		resp.ContentLength = int64(buf.Len())
 		resp.Body = ioutil.NopCloser(buf)
-		// } else if req.URL.Path == "/api/logging/start" {
-		// 	buf := bytes.NewBufferString("Starting to log")
-		// 	resp.ContentLength = int64(buf.Len())
-		// 	resp.Body = ioutil.NopCloser(buf)
-		// 	startLogging(clientIP)
-		// } else if req.URL.Path == "/api/logging/stop" {
-		// 	buf := bytes.NewBufferString("Stopping logging")
-		// 	resp.ContentLength = int64(buf.Len())
-		// 	resp.Body = ioutil.NopCloser(buf)
-		// 	stopLogging(clientIP)
-		// } else if req.URL.Path == "/api/logging/get" {
-		// 	resp.ContentLength = -1
-		// 	resp.Body = getLogs(clientIP)
-		// } else if req.URL.Path == "/api/logging/clear" {
-		// 	buf := bytes.NewBufferString("Clearing Clogs")
-		// 	resp.ContentLength = int64(buf.Len())
-		// 	resp.Body = ioutil.NopCloser(buf)
-		// 	clearLogs(clientIP)
+	} else if req.URL.Path == "/api/rules/activate" {
+		var names []string
+		for _, profile := range query["profile"] {
+			names = append(names, strings.Split(profile, ",")...)
+		}
+		err := activateProfiles(targetSession, names)
+		if err != nil {
+			setErrorBody(errResp, err)
+			return errResp
+		}
+		setBodyString(resp, "activating profiles")
+	} else if req.URL.Path == "/api/profiles" {
+		namesBytes, _ := json.Marshal(listProfiles())
+		setBodyString(resp, string(namesBytes))
+		resp.Header.Set("Content-Type", "application/json")
+	} else if req.URL.Path == "/api/profiles/get" {
+		source, ok := getProfile(query.Get("name"))
+		if !ok {
+			setBodyString(errResp, "No profile named "+query.Get("name"))
+			return errResp
+		}
+		setBodyString(resp, string(source))
+		resp.Header.Set("Content-Type", "application/json")
+	} else if strings.HasPrefix(req.URL.Path, "/api/sessions") && role != roleAdmin {
+		return forbidden("Only admins can see and close sessions")
+	} else if req.URL.Path == "/api/sessions" {
+		sessionsBytes, _ := json.Marshal(listSessions())
+		setBodyString(resp, string(sessionsBytes))
+		resp.Header.Set("Content-Type", "application/json")
+	} else if req.URL.Path == "/api/sessions/kill" {
+		forgetSession(targetSession)
+		closed := closeConnections(targetSession, 0)
+		setBodyString(resp, "killing session, closed "+strconv.Itoa(closed)+" connections")
+	} else if req.URL.Path == "/api/sessions/close" {
+		var id uint64
+		if query.Get("id") != "" {
+			var err error
+			id, err = strconv.ParseUint(query.Get("id"), 10, 64)
+			if err != nil || id == 0 {
+				setBodyString(errResp, "Illegal connection id "+query.Get("id"))
+				return errResp
+			}
+		}
+		closed := closeConnections(targetSession, id)
+		setBodyString(resp, "closed "+strconv.Itoa(closed)+" connections")
+	} else if (req.URL.Path == "/api/profiles/set" || req.URL.Path == "/api/profiles/delete") && role != roleAdmin {
+		return forbidden("Only admins can change profiles")
+	} else if req.URL.Path == "/api/profiles/set" {
+		source, err := ioutil.ReadAll(req.Body)
+		if err == nil {
+			err = setProfile(query.Get("name"), source)
+		}
+		if err != nil {
+			setErrorBody(errResp, err)
+			return errResp
+		}
+		setBodyString(resp, "saving profile")
+	} else if req.URL.Path == "/api/profiles/delete" {
+		err := deleteProfile(query.Get("name"))
+		if err != nil {
+			setErrorBody(errResp, err)
+			return errResp
+		}
+		setBodyString(resp, "deleting profile")
+	} else if req.URL.Path == "/api/logging/start" {
+		buf := bytes.NewBufferString("Starting to log")
+		resp.ContentLength = int64(buf.Len())
+		resp.Body = ioutil.NopCloser(buf)
+		startLogging(targetSession)
+	} else if req.URL.Path == "/api/logging/stop" {
+		buf := bytes.NewBufferString("Stopping logging")
+		resp.ContentLength = int64(buf.Len())
+		resp.Body = ioutil.NopCloser(buf)
+		stopLogging(targetSession)
+	} else if req.URL.Path == "/api/debug/start" {
+		startDebug(targetSession)
+		setBodyString(resp, "Starting to report the rules applied")
+	} else if req.URL.Path == "/api/debug/stop" {
+		stopDebug(targetSession)
+		setBodyString(resp, "Stopping to report the rules applied")
+	} else if req.URL.Path == "/api/logging/get" {
+		if query.Get("format") == "har" {
+			harBytes, err := getHarLogs(targetSession)
+			if err != nil {
+				setErrorBody(errResp, err)
+				return errResp
+			}
+			buf := bytes.NewBuffer(harBytes)
+			resp.ContentLength = int64(buf.Len())
+			resp.Body = ioutil.NopCloser(buf)
+		} else {
+			resp.ContentLength = -1
+			resp.Body = getLogs(targetSession)
+		}
+		resp.Header.Set("Content-Type", "application/json")
+	} else if req.URL.Path == "/api/logging/clear" {
+		buf := bytes.NewBufferString("Clearing logs")
+		resp.ContentLength = int64(buf.Len())
+		resp.Body = ioutil.NopCloser(buf)
+		clearLogs(targetSession)
+	} else if req.URL.Path == "/api/traffic/stream" {
+		resp.ContentLength = -1
+		resp.Body = subscribeTraffic(targetSession)
+		resp.Header.Set("Content-Type", "text/event-stream")
+		resp.Header.Set("Cache-Control", "no-cache")
+	} else if req.URL.Path == "/metrics" {
+		// The rule ids and hosts of every session are in there.
+		if role != roleAdmin {
+			return forbidden("Only admins can read the metrics")
+		}
+		var buf bytes.Buffer
+		metrics.WriteTo(&buf)
+		setBodyString(resp, buf.String())
+		resp.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	} else if req.URL.Path == "/" {
+		setBodyString(resp, uiPage)
+		resp.Header.Set("Content-Type", "text/html; charset=utf-8")
 	} else if req.URL.Path == "/ca.pem" {
 		buf := bytes.NewReader(caBytes)
 		resp.ContentLength = int64(buf.Len())
@@ -119,12 +387,40 @@ func handleProxyAPI(req *http.Request) *http.Response {
 	return resp
 }
 
+// Clients that have not used the proxy for this long lose their rules.
+const sessionExpiration = 48 * time.Hour
+
 var lastTimeUsed sync.Map // map[string]time.Time
 
 var rewriteRules sync.Map
 
 var throttledConnections sync.Map
 
+var faultCounters sync.Map // map[string]*sync.Map, counts requests per rule index
+
+// countRequest counts a request of session that matched the rule at entryIndex and
+// returns how many there have been so far.
+func countRequest(session string, entryIndex int) uint64 {
+	val, _ := faultCounters.LoadOrStore(session, &sync.Map{})
+	counters := val.(*sync.Map)
+	val, _ = counters.LoadOrStore(entryIndex, new(uint64))
+	return atomic.AddUint64(val.(*uint64), 1)
+}
+
+// connectionFault returns the fault to simulate on the client connection, if any.
+func connectionFault(fault *prxConfig.Fault) *proxy.Fault {
+	if fault.ResetAfter != nil {
+		return &proxy.Fault{Kind: proxy.FaultReset, After: *fault.ResetAfter}
+	}
+	if fault.TruncateAfter != nil {
+		return &proxy.Fault{Kind: proxy.FaultTruncate, After: *fault.TruncateAfter}
+	}
+	if fault.Hang {
+		return &proxy.Fault{Kind: proxy.FaultHang}
+	}
+	return nil
+}
+
 func launchSessionCleaner(period time.Duration, expiration time.Duration) {
 	for {
 		time.Sleep(period)
@@ -132,32 +428,93 @@ func launchSessionCleaner(period time.Duration, expiration time.Duration) {
 			func(key, val interface{}) bool {
 				if used, ok := val.(time.Time); ok {
 					if time.Now().After(used.Add(expiration)) {
-						lastTimeUsed.Delete(key)
-						rewriteRules.Delete(key)
-						throttledConnections.Delete(key)
+						forgetSession(key.(string))
 					}
 				}
 				return true
 			},
 		)
+		saveLastTimesUsed()
 	}
 }
 
 var caBytes []byte
 
+var prx = proxy.Proxy()
+
+const authRealm = "restfulHttpsProxy"
+
+// If set, clients have to log in and can only change their own session.
+var proxyAuth *proxy.Authenticator
+
 func main() {
 	var err error
 
 	var caPath string
 	var keyPath string
+	var sessionBy string
+	var sessionPortList string
+	var authPath string
+	var tokenPath string
+	var tlsPath string
 
 	flag.StringVar(&caPath, "pem", "ca.pem", "path to pem file")
 	flag.StringVar(&keyPath, "key", "key.pem", "path to key file")
+	flag.StringVar(&sessionDir, "sessions", sessionDir, "directory where the rules of the clients are kept across restarts")
+	flag.StringVar(&profileDir, "profiles", profileDir, "directory where the rule profiles are kept")
+	flag.StringVar(&responseDir, "responses", responseDir, "directory of the files that respond rules serve")
+	flag.StringVar(&sessionBy, "sessionBy", "", "how sessions are told apart, a comma separated list of ip, user, header:Name and port, the first one a request has is used (default ip, or user with -auth)")
+	flag.StringVar(&sessionPortList, "sessionPorts", "", "extra proxy ports, like 9001-9020, each one is a session if sessionBy has port")
+	flag.StringVar(&authPath, "auth", "", "file with one user:password per line, if set clients must log in to use the proxy and the API")
+	flag.StringVar(&tokenPath, "tokens", "", "file with one role:token per line, role is self or admin, if set the API needs a token")
+	flag.BoolVar(&prx.HTTP2, "http2", true, "use HTTP/2 with clients that offer it, and with the servers of their requests")
+	flag.StringVar(&tlsPath, "tls", "", "JSON file with the TLS versions and cipher suites to use with clients and servers")
 	flag.Parse()
 
+	if authPath != "" {
+		proxyAuth, err = proxy.LoadAuthenticator(authRealm, authPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if sessionBy == "" {
+			sessionBy = "user"
+		}
+	}
+	if sessionBy == "" {
+		sessionBy = "ip"
+	}
+	if tokenPath != "" {
+		if err := loadAPITokens(tokenPath); err != nil {
+			log.Fatal(err)
+		}
+	} else if proxyAuth != nil {
+		log.Print("Warning: -auth without -tokens, nobody is admin, so /metrics, /api/sessions, the profile changes and other sessions cannot be used")
+	}
+	if tlsPath != "" {
+		prx.ClientTLS, prx.UpstreamTLS, err = proxy.LoadTLSConfig(tlsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := parseSessionSources(sessionBy); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkSessionSources(proxyAuth != nil); err != nil {
+		log.Fatal(err)
+	}
+	var extraPorts []string
+	if sessionPortList != "" {
+		extraPorts, err = parseSessionPorts(sessionPortList)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
 	caBytes, _ = ioutil.ReadFile(caPath)
 
-	prx := proxy.Proxy()
+	prx.Auth = proxyAuth
 
 	prx.Cert, err = tls.LoadX509KeyPair(caPath, keyPath) // need to cache this
 	if err != nil {
@@ -184,69 +541,89 @@ func main() {
 			*http.Request,
 			*http.Response,
 		) {
-			ip, _ := proxy.SplitHostAndPort(req.RemoteAddr)
+			session := sessionKey(req, client)
+			removeSessionHeaders(req)
+			client.SetSession(session)
 
 			log.Print("[" + req.RemoteAddr + "] <" + req.Method + "> " + req.URL.String())
 
-			if req.ProtoMajor == 2 {
-				log.Println("SHOULD NOT HAVE HTTP2 REQUESTS")
-				log.Println(req.Proto)
-				log.Println(req.URL.String())
-			}
-
 			var resp *http.Response
+			var err error
 
-			lastTimeUsed.Store(ip, time.Now())
+			lastTimeUsed.Store(session, time.Now())
 
 			host, _ := proxy.SplitHostAndPort(req.URL.Host)
 
 			if host == "a.proxi" {
-				resp = handleProxyAPI(req)
+				resp = handleProxyAPI(req, session)
 				return req, resp
 			}
 
-			//requestCopy := copyRequest(req)
+			recorder := recordRoundTrip(session, req)
+			// Set before every return without a response, for the log.
+			var failure error
+			defer func() {
+				recorder.finishUnanswered(failure)
+			}()
 
-			val, _ := rewriteRules.Load(ip)
+			val, _ := rewriteRules.Load(session)
 			rewriteRulesForClient, _ := val.(prxConfig.RewriteRules)
 
 			originalReqURL := req.URL.String()
 
-			for _, entry := range rewriteRulesForClient {
-				if !entry.URL.MatchString(originalReqURL) {
-					continue
+			var reqBody []byte
+			if rewriteRulesForClient.NeedsRequestBody() {
+				reqBody, req.Body = peekBody(req.Body, maxMatchedBodySize)
+			}
+			// Decided before any rewrite, so that the response rules match the same entries.
+			ruleLogs := matchRules(rewriteRulesForClient, req, reqBody)
+			for i := range ruleLogs {
+				if ruleLogs[i].Matched {
+					ruleHits.Inc(ruleLogs[i].ID)
+					recorder.recordRule(ruleLogs[i].ID)
 				}
+			}
 
-				err := rewriteLogic.AlterURL(req.URL, entry.Rewrite.Request.URL)
-				if err != nil {
-					log.Print(err.Error())
-					return nil, nil
+			var respond *prxConfig.Respond
+			var connFault *proxy.Fault
+
+			for i, entry := range rewriteRulesForClient {
+				if !ruleLogs[i].Matched {
+					continue
+				}
+				if entry.Fault != nil {
+					if entry.Fault.DropFirst > 0 && countRequest(session, i) <= entry.Fault.DropFirst {
+						log.Print("[" + req.RemoteAddr + "] dropping " + originalReqURL)
+						requestsTotal.Inc(host, "dropped")
+						failure = errors.New("dropped by a fault rule")
+						return nil, nil
+					}
+					if entry.Fault.ErrorRate > 0 && rand.Float64() < entry.Fault.ErrorRate {
+						respond = &prxConfig.Respond{Status: entry.Fault.ErrorStatus}
+					}
+					if connFault == nil {
+						connFault = connectionFault(entry.Fault)
+					}
 				}
 
-				err = rewriteLogic.AlterHeader(&req.Header, entry.Rewrite.Request.Header)
-				if err != nil {
-					log.Print(err.Error())
-					return req, nil
+				if respond == nil {
+					respond = entry.Respond
 				}
 
-				// empty body might be replaced, fix this later
-				if len(entry.Rewrite.Request.Body) > 0 {
-					req.Body = rewriteLogic.AlterBody(
-						req.Body,
-						regexBufferSize,
-						entry.Rewrite.Request.Body,
-					)
-					req.ContentLength = -1
+				if err := rewriteRequest(&entry, req, &ruleLogs[i]); err != nil {
+					log.Print(err.Error())
+					failure = err
+					return nil, nil
 				}
 
 				if entry.UploadSpeed != nil {
 					var throttledClient *sync.Map
 					var throttleController *throttle.ThrottleController
-					if val, ok := throttledConnections.Load(ip); ok {
+					if val, ok := throttledConnections.Load(session); ok {
 						throttledClient = val.(*sync.Map)
 					} else {
 						throttledClient = &sync.Map{}
-						throttledConnections.Store(ip, throttledClient)
+						throttledConnections.Store(session, throttledClient)
 					}
 					if val, ok := throttledClient.Load("rq\n" + entry.URL.String()); ok {
 						throttleController = val.(*throttle.ThrottleController)
@@ -259,31 +636,47 @@ func main() {
 			}
 
 			req.Host = req.URL.Host
-			resp, err = server.RoundTrip(req)
-			if resp == nil {
-				log.Print(err)
-				return req, nil
+			recorder.recordRewrittenRequest(req)
+			req.Body = countBody(req.Body, requestBytes, host)
+			if respond != nil {
+				// The server is skipped, but the body must still be read off the client connection.
+				if req.Body != nil {
+					io.Copy(ioutil.Discard, req.Body)
+					req.Body.Close()
+				}
+				resp, err = mockResponse(req, respond)
+				if err != nil {
+					log.Print(err)
+					resp = proxy.NewResponse(req)
+					resp.StatusCode = 500
+					setBodyString(resp, err.Error())
+				}
+			} else {
+				var timings proxy.RoundTripTimings
+				resp, timings, err = server.TimedRoundTrip(req)
+				if resp == nil {
+					resp = proxy.CertificateErrorResponse(req, err)
+				}
+				if resp == nil {
+					log.Print(err)
+					requestsTotal.Inc(host, "error")
+					failure = err
+					return req, nil
+				}
+				recorder.recordOriginalResponse(resp, timings)
 			}
 
 			responseDelay := uint64(0)
+			streamed := streamsResponse(rewriteRulesForClient, ruleLogs, resp)
+			if streamed {
+				client.StreamResponse()
+			}
 
-			for _, entry := range rewriteRulesForClient {
-				if !entry.URL.MatchString(originalReqURL) {
+			for i, entry := range rewriteRulesForClient {
+				if !ruleLogs[i].Matched {
 					continue
 				}
-
-				rewriteLogic.AlterHeader(&resp.Header, entry.Rewrite.Response.Header)
-				rewriteLogic.AlterStatus(resp, entry.Rewrite.Response.Status)
-
-				// empty body might be replaced, fix this later
-				if len(entry.Rewrite.Response.Body) > 0 {
-					resp.Body = rewriteLogic.AlterBody(
-						resp.Body,
-						regexBufferSize,
-						entry.Rewrite.Response.Body,
-					)
-					resp.ContentLength = -1
-				}
+				rewriteResponse(&entry, resp, &ruleLogs[i], streamed)
 
 				if entry.ResponseDelay != nil && *entry.ResponseDelay > responseDelay {
 					responseDelay = *entry.ResponseDelay
@@ -292,11 +685,11 @@ func main() {
 				if entry.DownloadSpeed != nil {
 					var throttledClient *sync.Map
 					var throttleController *throttle.ThrottleController
-					if val, ok := throttledConnections.Load(ip); ok {
+					if val, ok := throttledConnections.Load(session); ok {
 						throttledClient = val.(*sync.Map)
 					} else {
 						throttledClient = &sync.Map{}
-						throttledConnections.Store(ip, throttledClient)
+						throttledConnections.Store(session, throttledClient)
 					}
 					if val, ok := throttledClient.Load(entry.URL.String()); ok {
 						throttleController = val.(*throttle.ThrottleController)
@@ -312,15 +705,45 @@ func main() {
 				time.Sleep(time.Duration(responseDelay) * time.Microsecond)
 			}
 
-			//responseCopy := copyResponse(resp)
-			//logRequest(ip, requestCopy, responseCopy)
-			//logRequest(ip, req, resp)
+			if connFault != nil {
+				client.InjectFault(connFault)
+			}
+
+			if isDebugging(session) {
+				resp.Header.Set(rulesAppliedHeader, rulesApplied(ruleLogs))
+				recorder.recordRuleLogs(ruleLogs)
+			}
+
+			if resp.StatusCode == http.StatusSwitchingProtocols && proxy.IsWebSocket(resp.Header) {
+				client.HandleWebSocket(newWebSocketHandler(rewriteRulesForClient, ruleLogs, recorder))
+				recorder.recordUpgrade(resp)
+			} else {
+				recorder.recordResponse(resp)
+			}
+			requestsTotal.Inc(host, strconv.Itoa(resp.StatusCode))
+			resp.Body = countBody(resp.Body, responseBytes, host)
 			return req, resp
 		},
 	)
-	go launchSessionCleaner(time.Minute, time.Hour*48)
-	go launchExposedAPI(":" + os.Args[1])
-	prx.Listen(":" + os.Args[2])
+	loadSessions(sessionExpiration)
+	loadProfiles()
+	go launchSessionCleaner(time.Minute, sessionExpiration)
+	go launchExposedAPI(":" + flag.Arg(0))
+	for _, port := range extraPorts {
+		go prx.Listen(":" + port)
+	}
+	prx.Listen(":" + flag.Arg(1))
+}
+
+type flushWriter struct {
+	io.Writer
+	flusher http.Flusher
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.flusher.Flush()
+	return n, err
 }
 
 func launchExposedAPI(host string) error {
@@ -328,9 +751,30 @@ func launchExposedAPI(host string) error {
 		host,
 		http.HandlerFunc(
 			func(w http.ResponseWriter, req *http.Request) {
-				resp := handleProxyAPI(req)
+				var resp *http.Response
+				// The API port is not behind the proxy, so it asks for the credentials itself.
+				if proxyAuth != nil && req.URL.Path != "/ca.pem" && req.URL.Path != "/" && tokenRole(req) == roleNone {
+					if user, ok := proxyAuth.Authenticate(req, "Authorization"); ok {
+						resp = handleProxyAPI(req, sessionKey(req, &proxy.ClientConnProps{User: user}))
+					} else {
+						resp = proxyAuth.Challenge(req, http.StatusUnauthorized)
+					}
+				} else {
+					resp = handleProxyAPI(req, sessionKey(req, nil))
+				}
+				for key, values := range resp.Header {
+					w.Header()[key] = values
+				}
 				w.WriteHeader(resp.StatusCode)
-				io.Copy(w, resp.Body)
+				if resp.Body != nil {
+					if flusher, ok := w.(http.Flusher); ok && resp.ContentLength == -1 {
+						// Streams must reach the client as they are written.
+						io.Copy(flushWriter{w, flusher}, resp.Body)
+					} else {
+						io.Copy(w, resp.Body)
+					}
+					resp.Body.Close()
+				}
 			},
 		),
 	)
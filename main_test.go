@@ -0,0 +1,211 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"restfulHttpsProxy/metrics"
+	"restfulHttpsProxy/proxy"
+	"restfulHttpsProxy/prxConfig"
+	"strings"
+	"testing"
+)
+
+// useTempSessionDir keeps the rules the test sets off the sessions directory.
+func useTempSessionDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir := sessionDir
+	sessionDir = dir
+	t.Cleanup(func() {
+		sessionDir = oldDir
+		os.RemoveAll(dir)
+	})
+}
+
+// callAPI sends a request to the API for session and returns the response
+// with its body.
+func callAPI(method string, path string, body string, session string) (*http.Response, string) {
+	req := httptest.NewRequest(method, "http://a.proxi"+path, strings.NewReader(body))
+	resp := handleProxyAPI(req, session)
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(respBody)
+}
+
+func TestClearRulesOfOtherSession(t *testing.T) {
+	useTempSessionDir(t)
+	apiTokens = []apiToken{{role: roleAdmin, token: "admin"}, {role: roleSelf, token: "self"}}
+	defer func() { apiTokens = nil }()
+
+	url := "a"
+	for _, session := range []string{"me", "other"} {
+		if err := setRules(session, prxConfig.Config{Rules: []prxConfig.EntryJSON{{URL: &url}}}); err != nil {
+			t.Fatal(err)
+		}
+		defer setRules(session, prxConfig.Config{})
+	}
+	clear := func(token string) int {
+		req := httptest.NewRequest("GET", "http://a.proxi/api/rules/clear?session=other", nil)
+		req.Header.Set("X-Proxy-Token", token)
+		return handleProxyAPI(req, "me").StatusCode
+	}
+
+	if status := clear("self"); status != http.StatusForbidden {
+		t.Errorf("self token got %d, want %d", status, http.StatusForbidden)
+	}
+	if len(getRules("other").Rules) != 1 {
+		t.Fatal("a self token cleared the rules of another session")
+	}
+	if status := clear("admin"); status != http.StatusOK {
+		t.Errorf("admin token got %d, want %d", status, http.StatusOK)
+	}
+	if len(getRules("other").Rules) != 0 {
+		t.Error("the rules of the other session were not cleared")
+	}
+	if len(getRules("me").Rules) != 1 {
+		t.Error("the rules of the admin were cleared instead")
+	}
+}
+
+func TestRuleHitsAreForgotten(t *testing.T) {
+	useTempSessionDir(t)
+	hasHits := func() bool {
+		var buf bytes.Buffer
+		metrics.WriteTo(&buf)
+		return strings.Contains(buf.String(), `prx_rule_hits_total{rule="shared"}`)
+	}
+	url := "a"
+	id := "shared"
+	for _, session := range []string{"a", "b"} {
+		if err := setRules(session, prxConfig.Config{Rules: []prxConfig.EntryJSON{{ID: id, URL: &url}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ruleHits.Inc(id)
+
+	setRules("a", prxConfig.Config{})
+	if !hasHits() {
+		t.Error("the hits were deleted while session b still has the rule")
+	}
+	forgetSession("b")
+	if hasHits() {
+		t.Error("the hits of a rule no session has were kept")
+	}
+}
+
+func TestUnansweredRoundTripIsLogged(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	rec := &roundTripRecorder{ip: "unanswered"}
+	rec.log.Req = snapshotRequest(req)
+	rec.finishUnanswered(errors.New("connection refused"))
+	entry := toHarEntry(rec.log)
+	if entry.Response.Status != 0 || entry.Error != "connection refused" {
+		t.Errorf("got status %d and error %q", entry.Response.Status, entry.Error)
+	}
+
+	rec = &roundTripRecorder{ip: "unanswered"}
+	rec.recordUpgrade(&http.Response{Status: "101 Switching Protocols", Header: http.Header{}})
+	rec.finishUnanswered(nil)
+	if rec.log.Error != "" {
+		t.Errorf("a round trip with a response got error %q", rec.log.Error)
+	}
+}
+
+func TestLogsStayInLogDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := logDir
+	logDir = filepath.Join(dir, "logs")
+	defer func() { logDir = oldDir }()
+
+	session := "header:/../../escaped"
+	getLogs(session).Close()
+	files, _ := ioutil.ReadDir(logDir)
+	if len(files) != 1 || files[0].Name() != "header:%2F..%2F..%2Fescaped.log" {
+		t.Errorf("got files %v in the log directory", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.log")); err == nil {
+		t.Error("the log file was created outside the log directory")
+	}
+	clearLogs(session)
+	if files, _ := ioutil.ReadDir(logDir); len(files) != 0 {
+		t.Errorf("got files %v after clearing the logs", files)
+	}
+}
+
+func TestMockResponseReadsResponseDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "responses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := responseDir
+	responseDir = dir
+	defer func() { responseDir = oldDir }()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"a": 1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	resp, err := mockResponse(req, &prxConfig.Respond{Status: http.StatusOK, File: "a.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != `{"a": 1}` {
+		t.Errorf("got body %q", body)
+	}
+	if _, err := mockResponse(req, &prxConfig.Respond{Status: http.StatusOK, File: "missing.json"}); err == nil {
+		t.Error("a missing file was served")
+	}
+}
+
+func TestAuthWithoutTokensHasNoAdmin(t *testing.T) {
+	proxyAuth = &proxy.Authenticator{}
+	defer func() { proxyAuth = nil }()
+	get := func(path string, token string) *http.Response {
+		req := httptest.NewRequest("GET", "http://a.proxi"+path, nil)
+		if token != "" {
+			req.Header.Set("X-Proxy-Token", token)
+		}
+		return handleProxyAPI(req, "user:alice")
+	}
+
+	for _, path := range []string{"/metrics", "/api/sessions", "/api/rules?session=user:bob"} {
+		resp := get(path, "")
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "-tokens") {
+			t.Errorf("%s: got %d %q, want %d and how to become admin", path, resp.StatusCode, body, http.StatusForbidden)
+		}
+	}
+
+	apiTokens = []apiToken{{role: roleAdmin, token: "admin"}}
+	defer func() { apiTokens = nil }()
+	if resp := get("/metrics", "admin"); resp.StatusCode != http.StatusOK {
+		t.Errorf("an admin token got %d for the metrics", resp.StatusCode)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"restfulHttpsProxy/metrics"
+	"restfulHttpsProxy/prxConfig"
+)
+
+var requestsTotal = metrics.NewCounter(
+	"prx_requests_total",
+	"Requests by server host and the status sent to the client, dropped if the connection was closed instead and error if the server could not be reached.",
+	"host", "status",
+)
+
+var requestBytes = metrics.NewCounter(
+	"prx_request_body_bytes_total",
+	"Bytes of request bodies sent to servers, after the rewrite rules.",
+	"host",
+)
+
+var responseBytes = metrics.NewCounter(
+	"prx_response_body_bytes_total",
+	"Bytes of response bodies sent to clients, after the rewrite rules.",
+	"host",
+)
+
+// Sessions are left out, they are client addresses or user names and come
+// and go too often.
+var ruleHits = metrics.NewCounter(
+	"prx_rule_hits_total",
+	"Requests that matched a rule, by rule id, summed over the sessions that have it.",
+	"rule",
+)
+
+// forgetRuleHits deletes the hits of the rules in old that no session has
+// anymore. It is called with rulesMu held, once the rules were replaced.
+func forgetRuleHits(old prxConfig.RewriteRules) {
+	if len(old) == 0 {
+		return
+	}
+	inUse := make(map[string]bool)
+	rewriteRules.Range(
+		func(key, val interface{}) bool {
+			for _, entry := range val.(prxConfig.RewriteRules) {
+				inUse[entry.ID] = true
+			}
+			return true
+		},
+	)
+	for _, entry := range old {
+		if !inUse[entry.ID] {
+			ruleHits.Delete(entry.ID)
+		}
+	}
+}
+
+// countingBody adds the bytes read from a body to counter.
+type countingBody struct {
+	io.ReadCloser
+	counter *metrics.Counter
+	host    string
+}
+
+func countBody(body io.ReadCloser, counter *metrics.Counter, host string) io.ReadCloser {
+	if body == nil {
+		return nil
+	}
+	return countingBody{body, counter, host}
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.Add(float64(n), b.host)
+	return n, err
+}
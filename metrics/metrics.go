@@ -0,0 +1,253 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Counters, gauges and histograms written in the Prometheus text format.
+// Every metric is registered when it is made and written by WriteTo.
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var registryMu sync.Mutex
+var registry = make(map[string]metric)
+
+func register(name string, m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("metric registered twice: " + name)
+	}
+	registry[name] = m
+}
+
+// WriteTo writes every metric, sorted by name.
+func WriteTo(w io.Writer) error {
+	registryMu.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	metrics := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = registry[name]
+	}
+	registryMu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+// labeled keeps one value per combination of label values.
+type labeled struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]interface{} // map[label values joined by \xff]value
+}
+
+func (l *labeled) key(labelValues []string) string {
+	if len(labelValues) != len(l.labels) {
+		panic(l.name + ": expected " + strconv.Itoa(len(l.labels)) + " label values")
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (l *labeled) writeHeader(w *bufio.Writer) {
+	w.WriteString("# HELP " + l.name + " " + strings.Replace(l.help, "\n", " ", -1) + "\n")
+	w.WriteString("# TYPE " + l.name + " " + l.kind + "\n")
+}
+
+// sortedKeys must be called with mu held.
+func (l *labeled) sortedKeys() []string {
+	keys := make([]string, 0, len(l.values))
+	for key := range l.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelString formats the labels of key and extra, like {host="a",le="1"}.
+func (l *labeled) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(l.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, l.labels[i]+"=\""+escapeLabel(value)+"\"")
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escapeLabel(extra[i+1])+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+/*
+--------------------------------------------------------------------------------
+*/
+
+// Counter is a value that only goes up.
+type Counter struct {
+	labeled
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{labeled{name: name, help: help, kind: "counter", labels: labels, values: make(map[string]interface{})}}
+	if len(labels) == 0 {
+		c.values[""] = float64(0) // shown before the first Inc
+	}
+	register(name, c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	value, _ := c.values[key].(float64)
+	c.values[key] = value + v
+	c.mu.Unlock()
+}
+
+// Delete removes the value of labelValues, so that labels that are gone for
+// good do not pile up.
+func (c *Counter) Delete(labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	delete(c.values, key)
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range c.sortedKeys() {
+		w.WriteString(c.name + c.labelString(key) + " " + formatFloat(c.values[key].(float64)) + "\n")
+	}
+}
+
+// GaugeFunc is a value that is read when the metrics are written.
+type GaugeFunc struct {
+	labeled
+	f func() float64
+}
+
+func NewGaugeFunc(name string, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{labeled{name: name, help: help, kind: "gauge"}, f}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	w.WriteString(g.name + " " + formatFloat(g.f()) + "\n")
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	labeled
+	buckets []float64 // upper bounds, sorted
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// DurationBuckets are the buckets for durations in seconds.
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		labeled{name: name, help: help, kind: "histogram", labels: labels, values: make(map[string]interface{})},
+		append([]float64(nil), buckets...),
+	}
+	sort.Float64s(h.buckets)
+	register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value, ok := h.values[key].(*histogramValue)
+	if !ok {
+		value = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		value.counts[i]++
+	}
+	value.count++
+	value.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range h.sortedKeys() {
+		value := h.values[key].(*histogramValue)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += value.counts[i]
+			w.WriteString(h.name + "_bucket" + h.labelString(key, "le", formatFloat(bound)) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		w.WriteString(h.name + "_bucket" + h.labelString(key, "le", "+Inf") + " " + strconv.FormatUint(value.count, 10) + "\n")
+		w.WriteString(h.name + "_sum" + h.labelString(key) + " " + formatFloat(value.sum) + "\n")
+		w.WriteString(h.name + "_count" + h.labelString(key) + " " + strconv.FormatUint(value.count, 10) + "\n")
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	registry = make(map[string]metric)
+	requests := NewCounter("test_requests_total", "Requests.", "host")
+	NewCounter("test_errors_total", "Errors.")
+	latency := NewHistogram("test_seconds", "Latency.", []float64{1, 0.1})
+	NewGaugeFunc("test_open", "Open.", func() float64 { return 3 })
+
+	requests.Inc(`a"b`)
+	requests.Add(2, "c")
+	requests.Inc("gone")
+	requests.Delete("gone")
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var buf bytes.Buffer
+	if err := WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"# HELP test_errors_total Errors.",
+		"# TYPE test_errors_total counter",
+		"test_errors_total 0",
+		"# HELP test_open Open.",
+		"# TYPE test_open gauge",
+		"test_open 3",
+		"# HELP test_requests_total Requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{host="a\"b"} 1`,
+		`test_requests_total{host="c"} 2`,
+		"# HELP test_seconds Latency.",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="0.1"} 1`,
+		`test_seconds_bucket{le="1"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_sum 5.55",
+		"test_seconds_count 3",
+		"",
+	}, "\n")
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
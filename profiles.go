@@ -0,0 +1,155 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"restfulHttpsProxy/prxConfig"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Profiles are named rule sets shared by every client, kept in a directory
+// with one file per profile.
+
+var profileDir = "profiles"
+
+var profilesMu sync.Mutex
+var profiles = make(map[string][]byte) // map[name]config JSON
+
+func profilePath(name string) string {
+	return filepath.Join(profileDir, url.PathEscape(name)+".json")
+}
+
+func loadProfiles() {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	files, err := ioutil.ReadDir(profileDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(err)
+		}
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		source, err := ioutil.ReadFile(filepath.Join(profileDir, file.Name()))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		profiles[name] = source
+	}
+}
+
+func listProfiles() []string {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	names := []string{}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getProfile(name string) ([]byte, bool) {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	source, ok := profiles[name]
+	return source, ok
+}
+
+// setProfile creates or replaces a profile, source must be a config that compiles.
+func setProfile(name string, source []byte) error {
+	if name == "" {
+		return errors.New("Profile needs a name")
+	}
+	config, err := prxConfig.ParseConfig(source)
+	if err != nil {
+		return err
+	}
+	if _, err := prxConfig.Compile(config); err != nil {
+		return err
+	}
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return err
+	}
+	path := profilePath(name)
+	if err := ioutil.WriteFile(path+".tmp", source, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	profiles[name] = source
+	return nil
+}
+
+func deleteProfile(name string) error {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	if _, ok := profiles[name]; !ok {
+		return errors.New("No profile named " + name)
+	}
+	delete(profiles, name)
+	return os.Remove(profilePath(name))
+}
+
+// activateProfiles makes the rules of the named profiles, in that order, the
+// rules of session.
+func activateProfiles(session string, names []string) error {
+	if len(names) == 0 {
+		return errors.New("No profile given")
+	}
+	var combined prxConfig.Config
+	for _, name := range names {
+		source, ok := getProfile(name)
+		if !ok {
+			return errors.New("No profile named " + name)
+		}
+		var config prxConfig.Config
+		if err := json.Unmarshal(source, &config); err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+		combined.Rules = append(combined.Rules, config.Rules...)
+	}
+	// The same rule can be in several profiles, the ids must stay unique.
+	used := make(map[string]bool)
+	for i := range combined.Rules {
+		if used[combined.Rules[i].ID] {
+			combined.Rules[i].ID = ""
+		}
+		used[combined.Rules[i].ID] = true
+	}
+	return setRules(session, combined)
+}
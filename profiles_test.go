@@ -0,0 +1,90 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"restfulHttpsProxy/prxConfig"
+	"strings"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	useTempSessionDir(t)
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir, oldProfiles := profileDir, profiles
+	profileDir, profiles = dir, make(map[string][]byte)
+	defer func() { profileDir, profiles = oldDir, oldProfiles }()
+	session := "profiles"
+	defer setRules(session, prxConfig.Config{})
+	ruleURLs := func() string {
+		urls := []string{}
+		ids := make(map[string]bool)
+		for _, entry := range getRules(session).Rules {
+			urls = append(urls, *entry.URL)
+			if ids[entry.ID] {
+				t.Errorf("more than one rule with id %s", entry.ID)
+			}
+			ids[entry.ID] = true
+		}
+		return strings.Join(urls, " ")
+	}
+
+	steps := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+		rules  string
+	}{
+		{"set", "/api/profiles/set?name=slow", `{"rules": [{"id": "s", "url": "slow"}]}`, http.StatusOK, ""},
+		{"set another", "/api/profiles/set?name=broken", `{"rules": [{"id": "s", "url": "slow"}, {"id": "b", "url": "broken"}]}`, http.StatusOK, ""},
+		{"set wrong rules", "/api/profiles/set?name=wrong", `{"rules": [{"url": "("}]}`, http.StatusNotFound, ""},
+		{"activate", "/api/rules/activate?profile=slow,broken", "", http.StatusOK, "slow slow broken"},
+		{"replace", "/api/profiles/set?name=slow", `{"rules": [{"id": "s", "url": "slower"}]}`, http.StatusOK, "slow slow broken"},
+		{"activate again", "/api/rules/activate?profile=slow", "", http.StatusOK, "slower"},
+		{"activate unknown", "/api/rules/activate?profile=slow&profile=nope", "", http.StatusNotFound, "slower"},
+		{"delete", "/api/profiles/delete?name=broken", "", http.StatusOK, "slower"},
+		{"delete again", "/api/profiles/delete?name=broken", "", http.StatusNotFound, "slower"},
+		{"activate deleted", "/api/rules/activate?profile=broken", "", http.StatusNotFound, "slower"},
+	}
+	for _, step := range steps {
+		resp, body := callAPI("POST", step.path, step.body, session)
+		if resp.StatusCode != step.status {
+			t.Errorf("%s: got %d %q, want %d", step.name, resp.StatusCode, body, step.status)
+		}
+		if got := ruleURLs(); got != step.rules {
+			t.Errorf("%s: got rules %q, want %q", step.name, got, step.rules)
+		}
+	}
+
+	// After a restart the profiles are read from the directory.
+	profiles = make(map[string][]byte)
+	loadProfiles()
+	if names := listProfiles(); len(names) != 1 || names[0] != "slow" {
+		t.Errorf("got profiles %v, want [slow]", names)
+	}
+	if _, body := callAPI("GET", "/api/profiles/get?name=slow", "", session); !strings.Contains(body, "slower") {
+		t.Errorf("got %q for the replaced profile", body)
+	}
+}
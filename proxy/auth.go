@@ -0,0 +1,310 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a Digest nonce can be used before the client has to get a new one.
+const nonceLifetime = time.Hour
+
+// Authenticator checks Basic and Digest credentials against a list of users.
+type Authenticator struct {
+	Realm string
+
+	passwords map[string]string // map[user]password
+	secret    []byte            // signs the nonces, so they don't have to be kept
+
+	// The last nc of every nonce a client used, so that a Digest header
+	// cannot be sent again.
+	countsMu  sync.Mutex
+	counts    map[string]nonceCount // map[nonce:cnonce]
+	lastSweep time.Time
+}
+
+type nonceCount struct {
+	nc      uint64
+	created time.Time // of the nonce
+}
+
+// NewAuthenticator returns an Authenticator for the users in passwords.
+func NewAuthenticator(realm string, passwords map[string]string) *Authenticator {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &Authenticator{Realm: realm, passwords: passwords, secret: secret}
+}
+
+// LoadAuthenticator reads a credential file with one user:password per
+// line, empty lines and lines starting with # are skipped.
+func LoadAuthenticator(realm string, path string) (*Authenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	passwords := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		credentials := strings.SplitN(line, ":", 2)
+		if len(credentials) != 2 || credentials[0] == "" {
+			return nil, errors.New(path + ":" + strconv.Itoa(lineNumber) + ": expected user:password")
+		}
+		passwords[credentials[0]] = credentials[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewAuthenticator(realm, passwords), nil
+}
+
+// splitAuth returns the lower case scheme and the parameters of the
+// credentials of req in header.
+func splitAuth(req *http.Request, header string) (string, string) {
+	auth := req.Header.Get(header)
+	i := strings.IndexByte(auth, ' ')
+	if i == -1 {
+		return "", ""
+	}
+	return strings.ToLower(auth[:i]), strings.TrimSpace(auth[i+1:])
+}
+
+// Authenticate checks the credentials of req in header, Proxy-Authorization
+// for the proxy or Authorization for a server, and returns the user.
+func (a *Authenticator) Authenticate(req *http.Request, header string) (string, bool) {
+	scheme, params := splitAuth(req, header)
+	switch scheme {
+	case "basic":
+		credentials, err := base64.StdEncoding.DecodeString(params)
+		if err != nil {
+			return "", false
+		}
+		userAndPassword := strings.SplitN(string(credentials), ":", 2)
+		if len(userAndPassword) != 2 {
+			return "", false
+		}
+		user := userAndPassword[0]
+		password, ok := a.passwords[user]
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(userAndPassword[1])) != 1 {
+			return "", false
+		}
+		return user, true
+	case "digest":
+		return a.checkDigest(req, parseAuthParams(params))
+	}
+	return "", false
+}
+
+// checkDigest accepts Digest credentials only for the target of req and only
+// once, the nc of a nonce must grow with every request.
+func (a *Authenticator) checkDigest(req *http.Request, params map[string]string) (string, bool) {
+	user, ok := a.digestUser(req.Method, params)
+	if !ok || !digestURIMatches(req, params["uri"]) {
+		return "", false
+	}
+	created, ok := a.nonceCreated(params["nonce"])
+	if !ok || time.Since(created) >= nonceLifetime {
+		return "", false
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil || !a.countNonce(params["nonce"]+":"+params["cnonce"], nc, created) {
+		return "", false
+	}
+	return user, true
+}
+
+// digestUser returns the user if the response of the Digest params is right,
+// whether the nonce has expired or not.
+func (a *Authenticator) digestUser(method string, params map[string]string) (string, bool) {
+	user := params["username"]
+	password, ok := a.passwords[user]
+	if !ok || params["realm"] != a.Realm {
+		return "", false
+	}
+	if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return "", false
+	}
+	// Without qop there is no nc, and nothing keeps the header from being
+	// sent again. The challenge always asks for qop auth.
+	if params["qop"] != "auth" {
+		return "", false
+	}
+	ha1 := md5Hex(user + ":" + a.Realm + ":" + password)
+	ha2 := md5Hex(method + ":" + params["uri"])
+	expected := md5Hex(ha1 + ":" + params["nonce"] + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(params["response"])) != 1 {
+		return "", false
+	}
+	return user, true
+}
+
+// digestURIMatches tells if uri, from a Digest header, is the target of req.
+// Clients send the target of the request line, the URL for a proxy and
+// host:port for a CONNECT, some only send the path.
+func digestURIMatches(req *http.Request, uri string) bool {
+	if req.RequestURI != "" && uri == req.RequestURI {
+		return true
+	}
+	if req.Method == http.MethodConnect {
+		return uri == req.URL.Host || uri == req.Host
+	}
+	return uri == req.URL.String() || uri == req.URL.RequestURI()
+}
+
+// countNonce records nc for key and tells if it is bigger than the last one.
+func (a *Authenticator) countNonce(key string, nc uint64, created time.Time) bool {
+	a.countsMu.Lock()
+	defer a.countsMu.Unlock()
+	if a.counts == nil {
+		a.counts = make(map[string]nonceCount)
+	}
+	// Expired nonces are refused anyway, their counts are not needed.
+	if time.Since(a.lastSweep) > nonceLifetime {
+		for used, count := range a.counts {
+			if time.Since(count.created) >= nonceLifetime {
+				delete(a.counts, used)
+			}
+		}
+		a.lastSweep = time.Now()
+	}
+	if last, ok := a.counts[key]; ok && nc <= last.nc {
+		return false
+	}
+	a.counts[key] = nonceCount{nc: nc, created: created}
+	return true
+}
+
+// A nonce is the time it was made and a signature of that time.
+func (a *Authenticator) newNonce() string {
+	created := strconv.FormatInt(time.Now().Unix(), 16)
+	return created + "-" + a.sign(created)
+}
+
+// nonceCreated returns when nonce was made, if the proxy made it.
+func (a *Authenticator) nonceCreated(nonce string) (time.Time, bool) {
+	parts := strings.SplitN(nonce, "-", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(a.sign(parts[0])), []byte(parts[1])) {
+		return time.Time{}, false
+	}
+	created, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(created, 0), true
+}
+
+// isStale tells if the Digest credentials of req in header are right but
+// their nonce has expired, then the client can retry with a new one without
+// asking the user.
+func (a *Authenticator) isStale(req *http.Request, header string) bool {
+	scheme, params := splitAuth(req, header)
+	if scheme != "digest" {
+		return false
+	}
+	digestParams := parseAuthParams(params)
+	if _, ok := a.digestUser(req.Method, digestParams); !ok {
+		return false
+	}
+	created, ok := a.nonceCreated(digestParams["nonce"])
+	return ok && time.Since(created) >= nonceLifetime
+}
+
+func (a *Authenticator) sign(s string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Challenge returns the response that asks the client for credentials,
+// status is 407 for the proxy or 401 for a server.
+func (a *Authenticator) Challenge(req *http.Request, status int) *http.Response {
+	resp := NewResponse(req)
+	resp.StatusCode = status
+	resp.Status = strconv.Itoa(status) + " " + http.StatusText(status)
+	header, authHeader := "WWW-Authenticate", "Authorization"
+	if status == http.StatusProxyAuthRequired {
+		header, authHeader = "Proxy-Authenticate", "Proxy-Authorization"
+	}
+	stale := ""
+	if a.isStale(req, authHeader) {
+		stale = ", stale=true"
+	}
+	resp.Header.Add(header, `Basic realm="`+a.Realm+`"`)
+	resp.Header.Add(header, `Digest realm="`+a.Realm+`", qop="auth", algorithm=MD5, nonce="`+a.newNonce()+`"`+stale)
+	body := []byte(http.StatusText(status))
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp
+}
+
+// parseAuthParams parses the comma separated key=value or key="value" pairs
+// of a Digest header.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimSpace(s[eq+1:])
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				break
+			}
+			value = s[1 : end+1]
+			s = s[end+2:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+		s = strings.TrimPrefix(strings.TrimSpace(s), ",")
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
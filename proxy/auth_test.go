@@ -0,0 +1,119 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticateBasic(t *testing.T) {
+	a := NewAuthenticator("test", map[string]string{"alice": "secret"})
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.SetBasicAuth(test.user, test.password)
+		user, ok := a.Authenticate(req, "Authorization")
+		if ok != test.ok || (ok && user != test.user) {
+			t.Errorf("%s:%s gave %q %v", test.user, test.password, user, ok)
+		}
+	}
+}
+
+// digestHeader returns the Digest credentials of alice for method and uri.
+func digestHeader(password, method, uri, nonce, nc, cnonce string) string {
+	ha1 := md5Hex("alice:test:" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	response := md5Hex(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+	return `Digest username="alice", realm="test", nonce="` + nonce + `", uri="` + uri + `", ` +
+		`qop=auth, nc=` + nc + `, cnonce="` + cnonce + `", response="` + response + `"`
+}
+
+func TestAuthenticateDigest(t *testing.T) {
+	a := NewAuthenticator("test", map[string]string{"alice": "secret"})
+	nonce := a.newNonce()
+	expired := "5f000000-" + a.sign("5f000000")
+	connect := func(nonce, nc, cnonce string) string {
+		return digestHeader("secret", "CONNECT", "example.com:443", nonce, nc, cnonce)
+	}
+	noQop := `Digest username="alice", realm="test", nonce="` + nonce + `", uri="example.com:443", response="` +
+		md5Hex(md5Hex("alice:test:secret")+":"+nonce+":"+md5Hex("CONNECT:example.com:443")) + `"`
+	// In order, a header is refused once its nc was used.
+	tests := []struct {
+		name    string
+		request string
+		header  string
+		ok      bool
+	}{
+		{"first", "CONNECT example.com:443 HTTP/1.1", connect(nonce, "00000001", "abc"), true},
+		{"replayed", "CONNECT example.com:443 HTTP/1.1", connect(nonce, "00000001", "abc"), false},
+		{"next", "CONNECT example.com:443 HTTP/1.1", connect(nonce, "00000002", "abc"), true},
+		{"older nc", "CONNECT example.com:443 HTTP/1.1", connect(nonce, "00000001", "abc"), false},
+		{"other cnonce", "CONNECT example.com:443 HTTP/1.1", connect(nonce, "00000001", "def"), true},
+		{"other host", "CONNECT other.com:443 HTTP/1.1", connect(nonce, "00000003", "abc"), false},
+		{"url", "GET http://example.com/a HTTP/1.1", digestHeader("secret", "GET", "http://example.com/a", nonce, "00000001", "u"), true},
+		{"path", "GET http://example.com/a HTTP/1.1", digestHeader("secret", "GET", "/a", nonce, "00000001", "p"), true},
+		{"other url", "GET http://example.com/b HTTP/1.1", digestHeader("secret", "GET", "http://example.com/a", nonce, "00000002", "u"), false},
+		{"wrong password", "CONNECT example.com:443 HTTP/1.1", digestHeader("wrong", "CONNECT", "example.com:443", nonce, "00000001", "w"), false},
+		{"no qop", "CONNECT example.com:443 HTTP/1.1", noQop, false},
+		{"expired", "CONNECT example.com:443 HTTP/1.1", connect(expired, "00000001", "abc"), false},
+		{"forged", "CONNECT example.com:443 HTTP/1.1", connect("6a000000-forged", "00000001", "abc"), false},
+	}
+	for _, test := range tests {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(test.request + "\r\nProxy-Authorization: " + test.header + "\r\n\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user, ok := a.Authenticate(req, "Proxy-Authorization"); ok != test.ok || (ok && user != "alice") {
+			t.Errorf("%s: got %q %v, want %v", test.name, user, ok, test.ok)
+		}
+	}
+}
+
+func TestChallengeStale(t *testing.T) {
+	a := NewAuthenticator("test", map[string]string{"alice": "secret"})
+	expired := "5f000000-" + a.sign("5f000000")
+	tests := []struct {
+		name   string
+		header string
+		stale  bool
+	}{
+		{"expired nonce", digestHeader("secret", "CONNECT", "example.com:443", expired, "00000001", "abc"), true},
+		{"expired nonce and wrong password", digestHeader("wrong", "CONNECT", "example.com:443", expired, "00000001", "abc"), false},
+		{"forged nonce", digestHeader("secret", "CONNECT", "example.com:443", "5f000000-forged", "00000001", "abc"), false},
+		{"no credentials", "", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("CONNECT", "http://example.com:443", nil)
+		if test.header != "" {
+			req.Header.Set("Proxy-Authorization", test.header)
+		}
+		challenge := a.Challenge(req, http.StatusProxyAuthRequired).Header["Proxy-Authenticate"]
+		if len(challenge) != 2 || strings.Contains(challenge[1], "stale=true") != test.stale {
+			t.Errorf("%s: got %q, want stale %v", test.name, challenge, test.stale)
+		}
+	}
+}
@@ -82,12 +82,120 @@ type ClientConnProps struct {
 	//state        http.ConnState
 
 	Conn                  net.Conn
+	rawConn               net.Conn // the accepted connection, before any TLS upgrade
 	idleTimeout           time.Duration
 	maxHeaderBytes        int64 // Not implemented yet
 	closeConnAfterRequest bool
+
+	User          string      // user name from the Proxy-Authorization header, checked if the proxy has an Authenticator
+	ConnectHeader http.Header // header of the CONNECT request that opened the tunnel, if any
+
+	ID     uint64    // unique for the life of the proxy
+	Opened time.Time // when the client connected
+	server *ServerConnProps
+	conn   *ClientConnProps // the connection, if these are the props of an HTTP/2 stream
+
+	infoMu  sync.Mutex // guards the fields below, they are read by other goroutines
+	user    string
+	session string
+
+	fault     *Fault
+	webSocket WebSocketHandler
+	streaming bool
+}
+
+// ConnInfo describes a client connection at one point in time.
+type ConnInfo struct {
+	ID       uint64
+	Client   string // address of the client
+	Proxy    string // address of the proxy the client connected to
+	User     string // see ClientConnProps.User
+	Session  string // see ClientConnProps.SetSession
+	Opened   time.Time
+	Upstream []string // "scheme://host:port" of the open server connections
+}
+
+// SetSession tags the connection with the session of its last request, so
+// that the connections of a session can be found.
+func (client *ClientConnProps) SetSession(session string) {
+	client.infoMu.Lock()
+	client.session = session
+	client.infoMu.Unlock()
+	if client.conn != nil {
+		client.conn.SetSession(session)
+	}
+}
+
+// stream returns the props of an HTTP/2 stream of the connection, streams
+// run at the same time so each one has its own server and fault.
+func (client *ClientConnProps) stream(server *ServerConnProps) *ClientConnProps {
+	client.infoMu.Lock()
+	defer client.infoMu.Unlock()
+	return &ClientConnProps{
+		Conn:          client.Conn,
+		rawConn:       client.rawConn,
+		idleTimeout:   client.idleTimeout,
+		User:          client.User,
+		ConnectHeader: client.ConnectHeader,
+		ID:            client.ID,
+		Opened:        client.Opened,
+		server:        server,
+		conn:          client,
+		user:          client.user,
+		session:       client.session,
+	}
+}
+
+func (client *ClientConnProps) setUser(user string) {
+	client.User = user
+	client.infoMu.Lock()
+	client.user = user
+	client.infoMu.Unlock()
+}
+
+// Info returns a description of the connection, it is safe to call from any goroutine.
+func (client *ClientConnProps) Info() ConnInfo {
+	client.infoMu.Lock()
+	info := ConnInfo{
+		ID:      client.ID,
+		User:    client.user,
+		Session: client.session,
+		Opened:  client.Opened,
+	}
+	client.infoMu.Unlock()
+	if client.rawConn != nil {
+		info.Client = client.rawConn.RemoteAddr().String()
+		info.Proxy = client.rawConn.LocalAddr().String()
+	}
+	if client.server != nil {
+		info.Upstream = client.server.Hosts()
+	}
+	return info
+}
+
+// LocalAddr returns the address of the proxy the client connected to.
+func (client *ClientConnProps) LocalAddr() string {
+	if client.rawConn == nil {
+		return ""
+	}
+	return client.rawConn.LocalAddr().String()
+}
+
+// InjectFault makes the next response written to the client fail with fault.
+func (client *ClientConnProps) InjectFault(fault *Fault) {
+	client.fault = fault
+}
+
+// StreamResponse makes the next response written to the client go out as
+// it is read, the headers are not held back until the first bytes of the
+// body came. Server-sent events always are.
+func (client *ClientConnProps) StreamResponse() {
+	client.streaming = true
 }
 
 func (client *ClientConnProps) Write(resp *http.Response) error {
+	streaming := client.streaming || IsEventStream(resp.Header)
+	client.streaming = false
 	resp.Header.Del("Connection")
 	resp.Header.Del("Content-Length")
 	resp.Header.Del("Transfer-Encoding")
@@ -96,7 +204,8 @@ func (client *ClientConnProps) Write(resp *http.Response) error {
 		resp.Body = nil
 	}
 
-	if resp.Body != nil && resp.ContentLength == -1 {
+	// A short body is read ahead to send it with a Content-Length.
+	if resp.Body != nil && resp.ContentLength == -1 && !streaming {
 		bodyBytes := make([]byte, 8192)
 		n, err := resp.Body.Read(bodyBytes)
 		if err == io.EOF {
@@ -108,6 +217,12 @@ func (client *ClientConnProps) Write(resp *http.Response) error {
 		}
 	}
 
+	fault := client.fault
+	client.fault = nil
+	if fault != nil {
+		fault.apply(client, resp)
+	}
+
 	if resp.ContentLength < 0 && !resp.Close {
 		if resp.ProtoMajor == 1 && resp.ProtoMinor == 1 {
 			resp.TransferEncoding = []string{"chunked"}
@@ -116,7 +231,35 @@ func (client *ClientConnProps) Write(resp *http.Response) error {
 			resp.Close = true
 		}
 	}
-	return resp.Write(client.Conn)
+	err := resp.Write(client.Conn)
+	if err != nil && fault != nil && fault.Kind == FaultReset {
+		client.reset()
+	}
+	return err
+}
+
+// reset closes the connection so that the client gets a TCP RST instead of
+// a FIN, without a TLS close_notify.
+func (client *ClientConnProps) reset() error {
+	if client.rawConn == nil {
+		return client.Close()
+	}
+	if tcpConn, ok := client.rawConn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	return client.rawConn.Close()
+}
+
+// Kill closes the client connection and its server connections, so that a
+// response that is still being sent stops as well.
+func (client *ClientConnProps) Kill() error {
+	if client.server != nil {
+		client.server.Close()
+	}
+	if client.rawConn != nil {
+		return client.rawConn.Close()
+	}
+	return client.Close()
 }
 
 func (client *ClientConnProps) Close() error {
@@ -0,0 +1,107 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+type FaultKind int
+
+const (
+	// FaultReset resets the client connection after After bytes of the body,
+	// or at its end if it is shorter.
+	FaultReset FaultKind = iota
+	// FaultTruncate closes the client connection after After bytes of the
+	// body, or at its end if it is shorter.
+	FaultTruncate
+	// FaultHang sends the headers and then stalls until the client gives up.
+	FaultHang
+)
+
+// Fault is a network fault simulated while a response is written to the client.
+type Fault struct {
+	Kind  FaultKind
+	After int64
+}
+
+var errFaultInjected = errors.New("fault injected")
+
+// faultReader returns errFaultInjected once left bytes have been read, or at
+// the end of a shorter body, so that the fault always happens.
+type faultReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (fr *faultReader) Read(p []byte) (int, error) {
+	if fr.left <= 0 {
+		return 0, errFaultInjected
+	}
+	if int64(len(p)) > fr.left {
+		p = p[:fr.left]
+	}
+	n, err := fr.r.Read(p)
+	fr.left -= int64(n)
+	if err == io.EOF {
+		err = errFaultInjected
+	}
+	return n, err
+}
+
+// hangReader blocks until the client closes the connection, anything the
+// client sends in the meantime is thrown away.
+type hangReader struct {
+	conn net.Conn
+}
+
+func (hr hangReader) Read(p []byte) (int, error) {
+	_, err := io.Copy(ioutil.Discard, hr.conn)
+	if err == nil {
+		err = io.EOF
+	}
+	return 0, err
+}
+
+func (f *Fault) apply(client *ClientConnProps, resp *http.Response) {
+	switch f.Kind {
+	case FaultReset, FaultTruncate:
+		if resp.Body == nil {
+			resp.Body = http.NoBody
+		}
+		if resp.ContentLength == 0 {
+			// Otherwise the body is read before the headers are sent.
+			resp.ContentLength = -1
+		}
+		resp.Body = ReadCloserPair{
+			r: &faultReader{r: resp.Body, left: f.After},
+			c: resp.Body,
+		}
+	case FaultHang:
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		resp.Body = ioutil.NopCloser(hangReader{conn: client.Conn})
+		if resp.ContentLength == 0 {
+			resp.ContentLength = -1
+		}
+	}
+}
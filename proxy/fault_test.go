@@ -0,0 +1,95 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// writeWithFault writes a response with body, nil if body is "-", to a
+// client with fault. It returns what the client got, the error of the write
+// and how the read of the client ended.
+func writeWithFault(t *testing.T, fault Fault, body string) (string, error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	proxyConn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &ClientConnProps{Conn: proxyConn, rawConn: proxyConn}
+
+	resp := NewResponse(httptest.NewRequest("GET", "http://example.com/", nil))
+	if body != "-" {
+		resp.Body = ioutil.NopCloser(strings.NewReader(body))
+		resp.ContentLength = int64(len(body))
+	}
+	client.InjectFault(&fault)
+	writeErr := client.Write(resp)
+	// Like the proxy does after an error.
+	client.Close()
+
+	got, readErr := ioutil.ReadAll(conn)
+	return string(got), writeErr, readErr
+}
+
+func TestConnectionFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault Fault
+		body  string
+		want  string // the end of what the client got
+		reset bool
+	}{
+		{"truncate", Fault{Kind: FaultTruncate, After: 5}, "hello world", "Content-Length: 11\r\n\r\nhello", false},
+		{"truncate short body", Fault{Kind: FaultTruncate, After: 100}, "hello", "Content-Length: 5\r\n\r\nhello", false},
+		{"truncate no body", Fault{Kind: FaultTruncate, After: 5}, "-", "Transfer-Encoding: chunked\r\n\r\n", false},
+		{"truncate empty body", Fault{Kind: FaultTruncate}, "", "Transfer-Encoding: chunked\r\n\r\n", false},
+		{"reset", Fault{Kind: FaultReset, After: 5}, "hello world", "", true},
+		{"reset no body", Fault{Kind: FaultReset}, "-", "", true},
+	}
+	for _, test := range tests {
+		got, writeErr, readErr := writeWithFault(t, test.fault, test.body)
+		if writeErr == nil {
+			t.Errorf("%s: the response was written without a fault", test.name)
+		}
+		if test.reset {
+			if readErr == nil {
+				t.Errorf("%s: got %q and no reset", test.name, got)
+			}
+			continue
+		}
+		if readErr != nil && readErr != io.EOF {
+			t.Errorf("%s: got %v, want the connection closed", test.name, readErr)
+		}
+		if !strings.HasSuffix(got, test.want) {
+			t.Errorf("%s: got %q, want it to end with %q", test.name, got, test.want)
+		}
+	}
+}
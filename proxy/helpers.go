@@ -17,8 +17,10 @@ limitations under the License.
 package proxy
 
 import (
+	"encoding/base64"
 	"errors"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strings"
@@ -84,6 +86,28 @@ func removeProxyHeaders(r *http.Request) {
 	r.Header.Del("Connection")
 }
 
+// IsEventStream tells if header is that of server-sent events, which must
+// reach the client as they come.
+func IsEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// proxyAuthUser returns the user name of the Basic credentials in the
+// Proxy-Authorization header, or "" if there are none.
+func proxyAuthUser(header http.Header) string {
+	auth := header.Get("Proxy-Authorization")
+	const prefix = "basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	credentials, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len(prefix):]))
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(string(credentials), ":", 2)[0]
+}
+
 func removeRedundantPort(u *url.URL) {
 	host, port := SplitHostAndPort(u.Host)
 	if u.Scheme == "http" && port == "80" {
@@ -0,0 +1,286 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const alpnH2 = "h2"
+
+// isHTTP2 tells if the client chose HTTP/2 in the TLS handshake.
+func isHTTP2(conn net.Conn) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	return ok && tlsConn.ConnectionState().NegotiatedProtocol == alpnH2
+}
+
+// connListener hands out a single connection, that net/http serves, and then
+// blocks until the connection is closed.
+type connListener struct {
+	conn     net.Conn
+	accepted bool
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.closed
+	return nil, errors.New("connection closed")
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// serveHTTP2 serves the streams of a client that chose HTTP/2, each one goes
+// through Modify like a request over HTTP/1.1. The servers are reached with
+// HTTP/2 if they support it.
+func (p *proxy) serveHTTP2(client *ClientConnProps) {
+	listener := &connListener{conn: client.Conn, closed: make(chan struct{})}
+	upstream := &ServerConnProps{
+		ResponseHeaderTimeout: p.ResponseHeaderTimeout,
+		TLS:                   &p.UpstreamTLS,
+		transport:             newUpstreamTransport(&p.UpstreamTLS, p.ResponseHeaderTimeout, p.IdleTimeout),
+	}
+	client.server = upstream
+	defer upstream.Close()
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			p.serveHTTP2Stream(client, upstream.transport, w, request)
+		}),
+		IdleTimeout: p.IdleTimeout,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	server.Serve(listener)
+}
+
+func (p *proxy) serveHTTP2Stream(client *ClientConnProps, transport *upstreamTransport, w http.ResponseWriter, request *http.Request) {
+	server := &ServerConnProps{
+		ResponseHeaderTimeout: p.ResponseHeaderTimeout,
+		TLS:                   &p.UpstreamTLS,
+		transport:             transport,
+	}
+	stream := client.stream(server)
+
+	request.RequestURI = ""
+	request.RemoteAddr = client.Conn.RemoteAddr().String()
+	request.URL.Scheme = "https"
+	request.URL.Host = resolveRealHost(*request.URL, request.Host)
+	request.Host = ""
+	removeProxyHeaders(request)
+	removeRedundantPort(request.URL)
+
+	var resp *http.Response
+	if p.Modify != nil {
+		request, resp = p.Modify(request, stream, server)
+	}
+	if request == nil {
+		// Like closing the connection over HTTP/1.1, the stream is reset.
+		panic(http.ErrAbortHandler)
+	}
+	if resp == nil {
+		var err error
+		resp, err = server.RoundTrip(request)
+		if resp == nil {
+			resp = CertificateErrorResponse(request, err)
+		}
+		if resp == nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+	stream.writeHTTP2(w, request, resp)
+}
+
+// Headers of HTTP/1.1 connections that HTTP/2 does not allow.
+var connectionHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// writeHTTP2 sends resp on the stream of request. Faults act like over
+// HTTP/1.1: a reset closes the whole connection, a truncation resets only the
+// stream and a hang stalls only the stream.
+func (client *ClientConnProps) writeHTTP2(w http.ResponseWriter, request *http.Request, resp *http.Response) {
+	fault := client.fault
+	client.fault = nil
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	defer resp.Body.Close()
+
+	header := w.Header()
+	for key, values := range resp.Header {
+		header[key] = values
+	}
+	for _, key := range connectionHeaders {
+		header.Del(key)
+	}
+	header.Del("Content-Length")
+	if resp.ContentLength >= 0 && (fault == nil || fault.Kind != FaultHang) {
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	for key := range resp.Trailer {
+		header.Add("Trailer", key)
+	}
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+
+	var body io.Reader = resp.Body
+	if fault != nil {
+		switch fault.Kind {
+		case FaultHang:
+			if flusher != nil {
+				flusher.Flush()
+			}
+			<-request.Context().Done()
+			return
+		case FaultReset, FaultTruncate:
+			body = &faultReader{r: resp.Body, left: fault.After}
+		}
+	}
+
+	// Flushed after every read, so that streamed responses are not held back.
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == errFaultInjected {
+			if fault.Kind == FaultReset {
+				client.reset()
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+	for key, values := range resp.Trailer {
+		header[key] = values
+	}
+}
+
+// upstreamTransport reaches servers over HTTP/2, or HTTP/1.1 for those that
+// don't support it.
+type upstreamTransport struct {
+	*http.Transport
+	dialTimings sync.Map // map[net.Conn]RoundTripTimings of connections no round trip used yet
+}
+
+func newUpstreamTransport(policy *TLSPolicy, responseHeaderTimeout time.Duration, idleTimeout time.Duration) *upstreamTransport {
+	t := &upstreamTransport{}
+	t.Transport = &http.Transport{
+		DialTLSContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			timings := RoundTripTimings{DNS: -1, Connect: -1, TLS: -1}
+			host, _ := SplitHostAndPort(addr)
+			conn, err := createConn(ctx, &url.URL{Scheme: "https", Host: addr}, &timings, policy.Settings(host), []string{alpnH2, alpnHTTP11})
+			if err == nil {
+				t.dialTimings.Store(conn, timings)
+			}
+			return conn, err
+		},
+		ForceAttemptHTTP2: true,
+		// Bodies are decoded like those of HTTP/1.1 servers, see decodeBody.
+		DisableCompression:    true,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		IdleConnTimeout:       idleTimeout,
+	}
+	return t
+}
+
+// roundTripTransport sends request with the transport of scp.
+func (scp *ServerConnProps) roundTripTransport(request *http.Request) (*http.Response, RoundTripTimings, error) {
+	var mu sync.Mutex
+	timings := RoundTripTimings{DNS: -1, Connect: -1, TLS: -1}
+	startedAt := time.Now()
+	var gotConnAt, sentAt, receivedAt time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			gotConnAt = time.Now()
+			if dial, ok := scp.transport.dialTimings.Load(info.Conn); ok {
+				scp.transport.dialTimings.Delete(info.Conn)
+				timings = dial.(RoundTripTimings)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			sentAt = time.Now()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			receivedAt = time.Now()
+			mu.Unlock()
+		},
+	}
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+	resp, err := scp.transport.RoundTrip(request)
+
+	mu.Lock()
+	if sentAt.IsZero() {
+		// The server answered before the whole request was sent.
+		sentAt = receivedAt
+	}
+	timings.Send = sentAt.Sub(gotConnAt)
+	timings.Wait = receivedAt.Sub(sentAt)
+	if timings.Send < 0 || timings.Wait < 0 {
+		timings.Send, timings.Wait = 0, 0
+	}
+	mu.Unlock()
+
+	if err != nil {
+		return nil, timings, err
+	}
+	upstreamSeconds.Observe(time.Since(startedAt).Seconds())
+	err = decodeBody(resp)
+	return resp, timings, err
+}
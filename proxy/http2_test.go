@@ -0,0 +1,165 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHTTP2 sends requests of an HTTP/2 client at the same time over one
+// connection, through the proxy to an HTTP/2 server.
+func TestHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Server-Proto", req.Proto)
+		w.Header().Set("X-Server-Saw", req.Header.Get("X-Rewritten"))
+		io.WriteString(w, "hello from "+req.URL.Path)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	serverAddr := server.Listener.Addr().String()
+
+	ca, err := getUntrustedCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverRoots := x509.NewCertPool()
+	serverRoots.AddCert(server.Certificate())
+
+	p := Proxy()
+	p.Cert = ca
+	p.UpstreamTLS.Default.RootCAs = serverRoots
+	p.OnRequest(func(request *http.Request, client *ClientConnProps, server *ServerConnProps) (*http.Request, *http.Response) {
+		switch request.URL.Path {
+		case "/drop":
+			return nil, nil
+		case "/truncate":
+			client.InjectFault(&Fault{Kind: FaultTruncate, After: 5})
+		}
+		request.URL.Host = serverAddr
+		request.Header.Set("X-Rewritten", "request")
+		resp, err := server.RoundTrip(request)
+		if err != nil {
+			t.Errorf("%s: %v", request.URL.Path, err)
+			return request, nil
+		}
+		resp.StatusCode = http.StatusCreated
+		resp.Header.Set("X-Rewritten", "response")
+		return request, resp
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.serve(l)
+	defer l.Close()
+
+	clientRoots := x509.NewCertPool()
+	clientRoots.AddCert(caCert)
+	var connects sync.Map
+	transport := &http.Transport{
+		Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()}),
+		TLSClientConfig:   &tls.Config{RootCAs: clientRoots},
+		ForceAttemptHTTP2: true,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				connects.Store(conn, true)
+			}
+			return conn, err
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	get := func(path string) (*http.Response, string, error) {
+		resp, err := client.Get("https://example.test" + path)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp, string(body), err
+	}
+	// One request first, so that the others share its connection.
+	if _, _, err := get("/first"); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{"/a", "/b", "/drop", "/c", "/truncate", "/d"}
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			resp, body, err := get(path)
+			switch path {
+			case "/drop":
+				if err == nil {
+					t.Errorf("%s: got status %d, want the stream reset", path, resp.StatusCode)
+				}
+				return
+			case "/truncate":
+				if err == nil || body != "hello" {
+					t.Errorf("%s: got body %q and error %v, want %q and an error", path, body, err, "hello")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("%s: %v", path, err)
+				return
+			}
+			if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusCreated {
+				t.Errorf("%s: got %s %d, want HTTP/2.0 %d", path, resp.Proto, resp.StatusCode, http.StatusCreated)
+			}
+			if proto := resp.Header.Get("X-Server-Proto"); proto != "HTTP/2.0" {
+				t.Errorf("%s: the server got %s, want HTTP/2.0", path, proto)
+			}
+			if resp.Header.Get("X-Server-Saw") != "request" || resp.Header.Get("X-Rewritten") != "response" {
+				t.Errorf("%s: the request or the response was not rewritten", path)
+			}
+			if body != "hello from "+path {
+				t.Errorf("%s: got body %q", path, body)
+			}
+		}(path)
+	}
+	wg.Wait()
+
+	n := 0
+	connects.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	if n != 1 {
+		t.Errorf("the client connected %d times, want every stream on one connection", n)
+	}
+}
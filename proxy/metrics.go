@@ -0,0 +1,54 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"restfulHttpsProxy/metrics"
+	"sync/atomic"
+)
+
+var upstreamSeconds = metrics.NewHistogram(
+	"prx_upstream_seconds",
+	"Time from connecting to a server to getting its response headers.",
+	metrics.DurationBuckets,
+)
+
+var upstreamErrors = metrics.NewCounter(
+	"prx_upstream_errors_total",
+	"Round trips to servers that failed.",
+)
+
+var upstreamCertificateErrors = metrics.NewCounter(
+	"prx_upstream_certificate_errors_total",
+	"Connections to servers whose certificate is not trusted.",
+)
+
+var tlsHandshakeFailures = metrics.NewCounter(
+	"prx_client_tls_handshake_failures_total",
+	"TLS handshakes with clients that failed, usually because the client does not trust the certificate.",
+)
+
+var tunnels = metrics.NewCounter(
+	"prx_tunnels_total",
+	"CONNECT tunnels passed through without being decrypted.",
+)
+
+var activeConnections = metrics.NewGaugeFunc(
+	"prx_client_connections",
+	"Open client connections.",
+	func() float64 { return float64(atomic.LoadInt64(&clientConns)) },
+)
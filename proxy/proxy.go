@@ -18,12 +18,14 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	//"io"
+	"io"
 	"io/ioutil"
 	//"log"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 	//"golang.org/x/net/http2"
@@ -69,6 +71,19 @@ type proxy struct {
 	MaxHeaderBytes        int64
 	MaxConnsKeptAlive     int64
 	ResponseHeaderTimeout time.Duration
+
+	// If set, clients must authenticate, the user is in ClientConnProps.User.
+	Auth *Authenticator
+
+	// TLS settings of the connections with clients, by the port they
+	// connected to, and with servers, by host.
+	ClientTLS   TLSPolicy
+	UpstreamTLS TLSPolicy
+
+	// If set, clients that offer HTTP/2 get it, see serveHTTP2.
+	HTTP2 bool
+
+	timeoutChecker sync.Once
 }
 
 func (p *proxy) handleConnect(connectRequest *http.Request, client net.Conn) (net.Conn, error) {
@@ -84,15 +99,19 @@ func (p *proxy) handleConnect(connectRequest *http.Request, client net.Conn) (ne
 	hostAndPort := resolveRealHost(*connectRequest.URL, connectRequest.Host)
 	host, _ := SplitHostAndPort(hostAndPort)
 	if mitm {
-		signedCert, _ := signHost(p.Cert, []string{host})
-
-		config := &tls.Config{
-			Certificates:             []tls.Certificate{signedCert},
-			InsecureSkipVerify:       true,
-			CipherSuites:             allTlsCipherSuites,
-			MinVersion:               tls.VersionSSL30,
-			PreferServerCipherSuites: true,
+		ca := p.Cert
+		if settings := p.UpstreamTLS.Settings(host); settings.OnVerifyFailure == VerifyFailureUntrusted {
+			// The server has to be asked before the client gets a certificate.
+			if err := checkUpstream(hostAndPort, settings); isCertificateError(err) {
+				upstreamCertificateErrors.Inc()
+				if ca, err = getUntrustedCA(); err != nil {
+					return nil, err
+				}
+			}
 		}
+		signedCert, _ := signHost(ca, []string{host})
+		_, listenerPort, _ := net.SplitHostPort(client.LocalAddr().String())
+		config := p.clientTLSConfig(signedCert, listenerPort)
 
 		_, err := client.Write([]byte(connectRequest.Proto + " 200 OK\r\n\r\n"))
 		if err != nil {
@@ -102,6 +121,7 @@ func (p *proxy) handleConnect(connectRequest *http.Request, client net.Conn) (ne
 		// Upgrade to a TLS connection
 		clientTLS := tls.Server(client, config)
 		if err := clientTLS.Handshake(); err != nil {
+			tlsHandshakeFailures.Inc()
 			return nil, err
 		}
 		return clientTLS, nil
@@ -112,6 +132,7 @@ func (p *proxy) handleConnect(connectRequest *http.Request, client net.Conn) (ne
 	}
 
 	client.Write([]byte(connectRequest.Proto + " 200 OK\r\n\r\n"))
+	tunnels.Inc()
 	doubleSidedCopy(client, server)
 	client.Close()
 	server.Close()
@@ -123,6 +144,7 @@ func (p *proxy) OnRequest(modify func(request *http.Request, client *ClientConnP
 }
 
 var clientConns int64 = 0
+var lastConnID uint64 = 0
 var InBlock int64 = 0
 
 // var serverConns int64 = 0
@@ -131,7 +153,9 @@ func (p *proxy) listenConn(client *ClientConnProps) {
 	server := &ServerConnProps{
 		ResponseHeaderTimeout: p.ResponseHeaderTimeout,
 		MaxConns:              5,
+		TLS:                   &p.UpstreamTLS,
 	}
+	client.server = server
 
 	atomic.AddInt64(&clientConns, 1)
 	defer atomic.AddInt64(&clientConns, -1)
@@ -158,15 +182,48 @@ func (p *proxy) listenConn(client *ClientConnProps) {
 		}
 		p.idleConns.Remove(client)
 
+		// Clients often only authenticate the CONNECT, so the user is kept for the connection.
+		if p.Auth != nil {
+			if client.User == "" || request.Header.Get("Proxy-Authorization") != "" {
+				user, ok := p.Auth.Authenticate(request, "Proxy-Authorization")
+				if !ok {
+					if request.Body != nil {
+						io.Copy(ioutil.Discard, request.Body)
+					}
+					if err := client.Write(p.Auth.Challenge(request, http.StatusProxyAuthRequired)); err != nil {
+						break
+					}
+					continue
+				}
+				client.setUser(user)
+			}
+		} else if user := proxyAuthUser(request.Header); user != "" {
+			client.setUser(user)
+		}
+
 		if request.Method == http.MethodConnect {
+			client.ConnectHeader = request.Header
 			// handleConnect will upgrade the connection to TLS
 			client.Conn, _ = p.handleConnect(request, client.Conn)
 			if client.Conn == nil {
 				break
 			}
+			if isHTTP2(client.Conn) {
+				p.serveHTTP2(client)
+				break
+			}
 			continue
 		}
 		request.RemoteAddr = client.Conn.RemoteAddr().String()
+		// Like net/http servers do, the HTTP/2 streams get it from there.
+		request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, client.Conn.LocalAddr()))
+		if !headerHasToken(request.Header, "Connection", "Upgrade") {
+			request.Header.Del("Upgrade")
+		}
+		if IsWebSocket(request.Header) {
+			// Messages compressed with permessage-deflate could not be read.
+			request.Header.Del("Sec-WebSocket-Extensions")
+		}
 		removeProxyHeaders(request)
 		removeRedundantPort(request.URL)
 
@@ -183,6 +240,9 @@ func (p *proxy) listenConn(client *ClientConnProps) {
 
 		if resp == nil {
 			resp, err = server.RoundTrip(request)
+			if resp == nil {
+				resp = CertificateErrorResponse(request, err)
+			}
 			if resp == nil {
 				//log.Print(err)
 				//client.Conn.Write([]byte(request.Proto + " 404 Not Found\r\n\r\n"))
@@ -190,6 +250,18 @@ func (p *proxy) listenConn(client *ClientConnProps) {
 			}
 		}
 
+		if upgraded := server.takeUpgraded(); upgraded != nil {
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				client.switchProtocols(resp, upgraded)
+				break
+			}
+			// A rule changed the 101, the server is not talked to anymore.
+			upgraded.Close()
+			resp.Body = nil
+			resp.ContentLength = 0
+			resp.Close = true
+		}
+
 		// if resp.ProtoAtLeast(1, 1) {
 		// 	if resp.Header.Get("Connection") == "close" {
 		// 		close = true
@@ -225,6 +297,11 @@ func (p *proxy) listenConn(client *ClientConnProps) {
 		}
 
 		err = client.Write(resp)
+		if client.webSocket != nil {
+			// The server did not switch to the WebSocket.
+			client.webSocket.Closed()
+			client.webSocket = nil
+		}
 		if err != nil {
 			//log.Print(err)
 			break
@@ -237,6 +314,9 @@ func (p *proxy) listenConn(client *ClientConnProps) {
 		client.lastUsedTime = time.Now()
 		p.idleConns.Add(client)
 	}
+	if client.webSocket != nil {
+		client.webSocket.Closed()
+	}
 	server.Close()
 	client.Close()
 	p.idleConns.Remove(client)
@@ -248,6 +328,7 @@ func Proxy() *proxy {
 	p.MaxHeaderBytes = 20000
 	p.MaxConnsKeptAlive = 30
 	p.ResponseHeaderTimeout = 30 * time.Second
+	p.HTTP2 = true
 	p.Modify = func(
 		req *http.Request,
 		conn *ClientConnProps,
@@ -278,9 +359,15 @@ func (p *proxy) Listen(host string) {
 		//log.Println(err)
 		return
 	}
+	p.serve(l)
+}
+
+// serve accepts the clients of l until it is closed.
+func (p *proxy) serve(l net.Listener) {
 	defer l.Close()
 
-	go p.launchTimeoutChecker()
+	// Listen can be called for several ports, one checker is enough.
+	p.timeoutChecker.Do(func() { go p.launchTimeoutChecker() })
 
 	// go func() {
 	// 	for {
@@ -303,10 +390,13 @@ func (p *proxy) Listen(host string) {
 			close = true
 		}
 		client := &ClientConnProps{
+			ID:           atomic.AddUint64(&lastConnID, 1),
+			Opened:       time.Now(),
 			lastUsedTime: time.Now(),
 			//state:        http.StateNew,
 
 			Conn:                  c,
+			rawConn:               c,
 			idleTimeout:           p.IdleTimeout,
 			maxHeaderBytes:        p.MaxHeaderBytes, // not supported
 			closeConnAfterRequest: close,
@@ -320,6 +410,20 @@ func (p *proxy) Listen(host string) {
 	}
 }
 
+// Connections returns the open client connections.
+func (p *proxy) Connections() []*ClientConnProps {
+	clients := []*ClientConnProps{}
+	p.conns.Range(
+		func(key, value interface{}) bool {
+			if client, ok := key.(*ClientConnProps); ok {
+				clients = append(clients, client)
+			}
+			return true
+		},
+	)
+	return clients
+}
+
 func (p *proxy) launchTimeoutChecker() {
 	for {
 		time.Sleep(time.Second)
@@ -20,6 +20,7 @@ import (
 	"bufio"
 	"compress/flate"
 	"compress/gzip"
+	"context"
 	"io"
 	//"compress/lzw" // Could not find server that uses this to test.
 	// TODO: add other compression algorithms
@@ -27,7 +28,9 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"sort"
 	"sync"
 	"time"
 	// 3rd party, probably slower, could use google's alternative
@@ -36,80 +39,94 @@ import (
 	"github.com/dsnet/compress/brotli"
 )
 
-// This order is really important, will fail to handshake if it isn't in this order for some sites.
-var allTlsCipherSuites = []uint16{
-	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
-	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
-	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
-
-	tls.TLS_RSA_WITH_RC4_128_SHA,
-	tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
-	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
-	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
-	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
-	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
-
-	// we dont support tls1.3 for now, need special env var to enable it.
-
-	// tls.TLS_AES_128_GCM_SHA256,
-	// tls.TLS_AES_256_GCM_SHA384,
-	// tls.TLS_CHACHA20_POLY1305_SHA256,
-
-	tls.TLS_FALLBACK_SCSV,
+// RoundTripTimings holds how long each phase of a round trip took.
+// DNS, Connect and TLS are -1 when an already open connection was reused,
+// DNS also when the host is an ip.
+type RoundTripTimings struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	Send    time.Duration
+	Wait    time.Duration
 }
 
-func createConn(dst *url.URL) (net.Conn, error) {
+func createConn(ctx context.Context, dst *url.URL, timings *RoundTripTimings, settings TLSSettings, nextProtos []string) (net.Conn, error) {
 	dstWithPort := *dst
 	insertPort(&dstWithPort)
+	host, _ := SplitHostAndPort(dstWithPort.Host)
 	dialer := &net.Dialer{
 		Timeout: 5 * time.Second,
 	}
-	if dst.Scheme != "https" {
-		server, err := dialer.Dial(
-			"tcp",
-			dstWithPort.Host,
-		)
-		if err != nil {
-			if server != nil {
-				server.Close()
+
+	// The dialer reports its lookup and connects, racing connects to other
+	// addresses may still report after it returned.
+	var mu sync.Mutex
+	var dialed bool
+	var dnsStart, connectStart time.Time
+	dns, connect := time.Duration(-1), time.Duration(-1)
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !dialed {
+				dns = time.Since(dnsStart)
 			}
-			return nil, err
-		}
-		return server, err
+		},
+		ConnectStart: func(network string, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if connectStart.IsZero() {
+				connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network string, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && !dialed {
+				connect = time.Since(connectStart)
+			}
+		},
 	}
-	config := &tls.Config{
-		InsecureSkipVerify:       true,
-		CipherSuites:             allTlsCipherSuites,
-		MinVersion:               tls.VersionSSL30,
-		MaxVersion:               tls.VersionTLS12,
-		PreferServerCipherSuites: false,
-	}
-	server, err := tls.DialWithDialer(
-		dialer,
-		"tcp",
-		dstWithPort.Host,
-		config,
-	)
+	server, err := dialer.DialContext(httptrace.WithClientTrace(ctx, trace), "tcp", dstWithPort.Host)
+	mu.Lock()
+	dialed = true
+	timings.DNS, timings.Connect = dns, connect
+	mu.Unlock()
 	if err != nil {
-		if server != nil {
-			server.Close()
-		}
 		return nil, err
 	}
-	return server, err
+
+	if dst.Scheme != "https" {
+		return server, nil
+	}
+	// The certificate is verified after the handshake, so that an untrusted
+	// server can be told apart from one that failed the handshake.
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+		NextProtos:         nextProtos,
+	}
+	settings.apply(config)
+	start := time.Now()
+	serverTLS := tls.Client(server, config)
+	server.SetDeadline(start.Add(dialer.Timeout))
+	if err := serverTLS.Handshake(); err != nil {
+		server.Close()
+		return nil, err
+	}
+	if err := settings.verify(host, serverTLS.ConnectionState()); err != nil {
+		upstreamCertificateErrors.Inc()
+		server.Close()
+		return nil, err
+	}
+	server.SetDeadline(time.Time{})
+	timings.TLS = time.Since(start)
+	return serverTLS, nil
 }
 
 type ServerConnProps struct {
@@ -121,17 +138,42 @@ type ServerConnProps struct {
 	ResponseHeaderTimeout time.Duration
 	maxHeaderBytes        int64 // Not implemented yet
 
+	// TLS settings of the connections to servers, by host.
+	TLS *TLSPolicy
+
+	// If set, round trips go through it instead of Conns, for the streams of
+	// HTTP/2 clients.
+	transport *upstreamTransport
+
+	// The connection of the last response, if it switched protocols.
+	upgraded net.Conn
+
 	listenLoopMu sync.Mutex
 	writeLoopMu  sync.Mutex
 	connsMu      sync.Mutex
 }
 
 func (scp *ServerConnProps) Close() error {
+	if scp.transport != nil {
+		scp.transport.CloseIdleConnections()
+	}
 	scp.connsMu.Lock()
 	defer scp.connsMu.Unlock()
 	return scp.close()
 }
 
+// Hosts returns the "scheme://host:port" of every open connection.
+func (scp *ServerConnProps) Hosts() []string {
+	scp.connsMu.Lock()
+	defer scp.connsMu.Unlock()
+	hosts := []string{}
+	for host := range scp.Conns {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
 func (scp *ServerConnProps) close() error {
 	var err error
 	for _, conn := range scp.Conns {
@@ -146,11 +188,34 @@ func (scp *ServerConnProps) close() error {
 }
 
 func (scp *ServerConnProps) RoundTrip(request *http.Request) (*http.Response, error) {
+	resp, _, err := scp.TimedRoundTrip(request)
+	return resp, err
+}
+
+// TimedRoundTrip is RoundTrip that also tells how long the phases of the
+// round trip took.
+func (scp *ServerConnProps) TimedRoundTrip(request *http.Request) (*http.Response, RoundTripTimings, error) {
 	if request == nil {
-		return nil, errors.New("request is nil")
+		return nil, RoundTripTimings{}, errors.New("request is nil")
+	}
+	// Counted once, a round trip can be tried twice.
+	resp, timings, err := scp.timedRoundTrip(request)
+	if err != nil {
+		upstreamErrors.Inc()
 	}
+	return resp, timings, err
+}
+
+func (scp *ServerConnProps) timedRoundTrip(request *http.Request) (*http.Response, RoundTripTimings, error) {
 	request.Header.Set("Accept-Encoding", "identity, gzip, deflate, br")
+	if scp.transport != nil {
+		return scp.roundTripTransport(request)
+	}
+	upgrade := request.Header.Get("Upgrade") != ""
 	request.Header.Del("Connection")
+	if upgrade {
+		request.Header.Set("Connection", "Upgrade")
+	}
 	request.Header.Del("Content-Length")
 	request.Header.Del("Transfer-Encoding")
 
@@ -180,27 +245,28 @@ func (scp *ServerConnProps) RoundTrip(request *http.Request) (*http.Response, er
 	}
 
 	var resp *http.Response
+	var timings RoundTripTimings
 	var errS error
 	var errR error
 
 	if request.Body == nil {
-		resp, errS, errR = scp.tryRoundTrip(request)
-		if errS != nil {
-			resp, errS, errR = scp.tryRoundTrip(request)
+		resp, timings, errS, errR = scp.tryRoundTrip(request)
+		if errS != nil && !isCertificateError(errS) {
+			resp, timings, errS, errR = scp.tryRoundTrip(request)
 		}
 	} else {
 		body := ReadCloserStats(request.Body)
 		request.Body = body
 
-		resp, errS, errR = scp.tryRoundTrip(request)
-		if errS != nil && !body.Used {
-			resp, errS, errR = scp.tryRoundTrip(request)
+		resp, timings, errS, errR = scp.tryRoundTrip(request)
+		if errS != nil && !body.Used && !isCertificateError(errS) {
+			resp, timings, errS, errR = scp.tryRoundTrip(request)
 		}
 	}
 	if errS != nil {
-		return resp, errS
+		return resp, timings, errS
 	}
-	return resp, errR
+	return resp, timings, errR
 }
 
 func cancelHandle(f func()) (cancel func(), action func()) {
@@ -214,14 +280,16 @@ func cancelHandle(f func()) (cancel func(), action func()) {
 	return action, cancel
 }
 
-// returns (*http.Response, error sending request, error getting response)
-func (scp *ServerConnProps) tryRoundTrip(request *http.Request) (*http.Response, error, error) {
+// returns (*http.Response, timings, error sending request, error getting response)
+func (scp *ServerConnProps) tryRoundTrip(request *http.Request) (*http.Response, RoundTripTimings, error, error) {
 	var errS error
 	var errR error
 
-	errS = scp.Open(request)
+	timings := RoundTripTimings{DNS: -1, Connect: -1, TLS: -1}
+	openedAt := time.Now()
+	errS = scp.Open(request, &timings)
 	if errS != nil {
-		return nil, errS, errR
+		return nil, timings, errS, errR
 	}
 
 	if scp.Conn != nil && request.Header.Get("Remote-Address") != "" {
@@ -233,8 +301,11 @@ func (scp *ServerConnProps) tryRoundTrip(request *http.Request) (*http.Response,
 
 	timeoutFunc, cancelTimeoutFunc := cancelHandle(func() { scp.Close() })
 	var resp *http.Response
+	var sentAt, receivedAt time.Time
+	startedAt := time.Now()
 	go func() {
 		errS := scp.Write(request)
+		sentAt = time.Now()
 		if errS != nil {
 			scp.Close()
 		} else {
@@ -247,6 +318,7 @@ func (scp *ServerConnProps) tryRoundTrip(request *http.Request) (*http.Response,
 	}()
 	go func() {
 		resp, errR = scp.Listen(request)
+		receivedAt = time.Now()
 		cancelTimeoutFunc()
 		if errR != nil {
 			scp.Close()
@@ -255,10 +327,22 @@ func (scp *ServerConnProps) tryRoundTrip(request *http.Request) (*http.Response,
 	}()
 	wg.Wait()
 
-	return resp, errS, errR
+	timings.Send = sentAt.Sub(startedAt)
+	timings.Wait = receivedAt.Sub(sentAt)
+	if timings.Wait < 0 {
+		// The server answered before the whole request was sent.
+		timings.Wait = 0
+	}
+	if errS == nil && errR == nil {
+		upstreamSeconds.Observe(receivedAt.Sub(openedAt).Seconds())
+	}
+
+	return resp, timings, errS, errR
 }
 
-func (scp *ServerConnProps) Open(request *http.Request) error {
+// Open makes scp.Conn a connection to the server of request, a new one is
+// timed in timings.
+func (scp *ServerConnProps) Open(request *http.Request, timings *RoundTripTimings) error {
 	scp.connsMu.Lock()
 	defer scp.connsMu.Unlock()
 
@@ -278,7 +362,8 @@ func (scp *ServerConnProps) Open(request *http.Request) error {
 	if len(scp.Conns) > scp.MaxConns {
 		scp.close()
 	}
-	server, err := createConn(&dst)
+	serverHost, _ := SplitHostAndPort(dst.Host)
+	server, err := createConn(request.Context(), &dst, timings, scp.TLS.Settings(serverHost), []string{alpnHTTP11})
 	if err != nil {
 		scp.Conn = nil
 		return err
@@ -299,15 +384,60 @@ func (scp *ServerConnProps) Listen(request *http.Request) (*http.Response, error
 	scp.listenLoopMu.Lock()
 	defer scp.listenLoopMu.Unlock()
 
+	reader := bufio.NewReader(scp.Conn)
 	resp, err := http.ReadResponse(
-		bufio.NewReader(scp.Conn),
+		reader,
 		request,
 	)
 
 	if resp == nil {
 		return resp, err
 	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		scp.takeConn(&upgradedConn{Conn: scp.Conn, r: reader})
+		return resp, nil
+	}
+	err = decodeBody(resp)
+
+	if resp.ContentLength == -1 && !contains(resp.TransferEncoding, "chunked") && !resp.Close {
+		resp.TransferEncoding = []string{"chunked"}
+	}
 
+	if resp.Close {
+		resp.Body = NewReadDoubleCloser(resp.Body, scp.Conn)
+	}
+
+	return resp, err
+}
+
+// takeConn keeps the connection that switched protocols out of Conns, so
+// that no other request uses it.
+func (scp *ServerConnProps) takeConn(upgraded *upgradedConn) {
+	scp.connsMu.Lock()
+	defer scp.connsMu.Unlock()
+	for host, conn := range scp.Conns {
+		if conn == upgraded.Conn {
+			delete(scp.Conns, host)
+		}
+	}
+	scp.Conn = nil
+	scp.upgraded = upgraded
+}
+
+// takeUpgraded returns the connection of the last response if it switched
+// protocols, only once.
+func (scp *ServerConnProps) takeUpgraded() net.Conn {
+	scp.connsMu.Lock()
+	defer scp.connsMu.Unlock()
+	upgraded := scp.upgraded
+	scp.upgraded = nil
+	return upgraded
+}
+
+// decodeBody undoes the Content-Encoding of resp, so that rules see the body
+// as it is.
+func decodeBody(resp *http.Response) error {
+	var err error
 	switch resp.Header.Get("Content-Encoding") {
 	case "gzip":
 		var gzipReader *gzip.Reader
@@ -336,14 +466,5 @@ func (scp *ServerConnProps) Listen(request *http.Request) (*http.Response, error
 		// 	resp.Header.Del("Content-Encoding")
 		// 	resp.ContentLength = -1
 	}
-
-	if resp.ContentLength == -1 && !contains(resp.TransferEncoding, "chunked") && !resp.Close {
-		resp.TransferEncoding = []string{"chunked"}
-	}
-
-	if resp.Close {
-		resp.Body = NewReadDoubleCloser(resp.Body, scp.Conn)
-	}
-
-	return resp, err
+	return err
 }
@@ -0,0 +1,97 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"restfulHttpsProxy/metrics"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimedRoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer server.Close()
+	// By name, so that the lookup is timed too.
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	scp := &ServerConnProps{MaxConns: 2, ResponseHeaderTimeout: 5 * time.Second}
+	defer scp.Close()
+	for i, connected := range []bool{true, false} {
+		req, _ := http.NewRequest("GET", url, nil)
+		resp, timings, err := scp.TimedRoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("request %d: got body %q", i, body)
+		}
+		if (timings.DNS >= 0) != connected || (timings.Connect >= 0) != connected {
+			t.Errorf("request %d: got dns %v and connect %v, want them only for a new connection", i, timings.DNS, timings.Connect)
+		}
+		if timings.TLS != -1 || timings.Wait < 0 {
+			t.Errorf("request %d: got tls %v and wait %v", i, timings.TLS, timings.Wait)
+		}
+	}
+}
+
+func counterValue(t *testing.T, name string) float64 {
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, name+" "), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return value
+		}
+	}
+	return 0
+}
+
+func TestFailedRoundTripIsCountedOnce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens there any more, both tries fail.
+	addr := l.Addr().String()
+	l.Close()
+
+	scp := &ServerConnProps{MaxConns: 2, ResponseHeaderTimeout: 5 * time.Second}
+	defer scp.Close()
+	before := counterValue(t, "prx_upstream_errors_total")
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	if _, err := scp.RoundTrip(req); err == nil {
+		t.Fatal("the round trip to a closed port worked")
+	}
+	if errors := counterValue(t, "prx_upstream_errors_total") - before; errors != 1 {
+		t.Errorf("got %v upstream errors, want 1", errors)
+	}
+}
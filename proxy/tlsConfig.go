@@ -0,0 +1,314 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Old devices are a big part of what gets tested through the proxy, so
+// TLS 1.0 is still allowed unless the settings say otherwise.
+const defaultMinTLSVersion = tls.VersionTLS10
+
+// TLSSettings are the TLS versions and cipher suites of one leg of the
+// proxy, zero values are the defaults.
+type TLSSettings struct {
+	MinVersion uint16
+	MaxVersion uint16 // the newest version Go has if 0
+	// Only for TLS 1.2 and older, the TLS 1.3 suites cannot be chosen.
+	CipherSuites []uint16
+
+	// The rest is only for servers.
+
+	RootCAs *x509.CertPool // the system roots if nil
+	// SHA-256 hashes of public keys (SubjectPublicKeyInfo), if set one of
+	// the certificates of the server must have one of them.
+	Pins               [][]byte
+	InsecureSkipVerify *bool  // not verified against RootCAs if true, the pins are still checked
+	OnVerifyFailure    string // VerifyFailureBlock if empty
+}
+
+// What the proxy does when the certificate of a server cannot be trusted.
+const (
+	// VerifyFailureBlock answers with an error page.
+	VerifyFailureBlock = "block"
+	// VerifyFailureUntrusted gives the client a certificate it does not
+	// trust, so that it fails like it would without the proxy.
+	VerifyFailureUntrusted = "untrusted"
+)
+
+func (settings TLSSettings) apply(config *tls.Config) {
+	config.MinVersion = settings.MinVersion
+	if config.MinVersion == 0 {
+		config.MinVersion = defaultMinTLSVersion
+	}
+	config.MaxVersion = settings.MaxVersion
+	config.CipherSuites = settings.CipherSuites
+}
+
+// TLSPolicy picks the TLSSettings for a name, the port of a listener or the
+// host of a server.
+type TLSPolicy struct {
+	Default TLSSettings
+	// Settings for some names, "*.example.com" is for every subdomain of
+	// example.com. Zero values are taken from Default.
+	ByName map[string]TLSSettings
+}
+
+// Settings returns the settings for name, a nil policy has the defaults.
+func (policy *TLSPolicy) Settings(name string) TLSSettings {
+	if policy == nil {
+		return TLSSettings{}
+	}
+	settings := policy.Default
+	named, ok := policy.ByName[name]
+	for rest := name; !ok && strings.Contains(rest, "."); {
+		rest = rest[strings.Index(rest, ".")+1:]
+		named, ok = policy.ByName["*."+rest]
+	}
+	if !ok {
+		return settings
+	}
+	if named.MinVersion != 0 {
+		settings.MinVersion = named.MinVersion
+	}
+	if named.MaxVersion != 0 {
+		settings.MaxVersion = named.MaxVersion
+	}
+	if named.CipherSuites != nil {
+		settings.CipherSuites = named.CipherSuites
+	}
+	if named.RootCAs != nil {
+		settings.RootCAs = named.RootCAs
+	}
+	if named.Pins != nil {
+		settings.Pins = named.Pins
+	}
+	if named.InsecureSkipVerify != nil {
+		settings.InsecureSkipVerify = named.InsecureSkipVerify
+	}
+	if named.OnVerifyFailure != "" {
+		settings.OnVerifyFailure = named.OnVerifyFailure
+	}
+	return settings
+}
+
+const alpnHTTP11 = "http/1.1"
+
+// clientTLSConfig is the config of the TLS server the client talks to, for a
+// client that connected to listener port.
+func (p *proxy) clientTLSConfig(cert tls.Certificate, port string) *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	p.ClientTLS.Settings(port).apply(config)
+	// Only the protocols the client offers are listed, clients that offer
+	// neither h2 nor http/1.1, that may speak something else than HTTP on
+	// port 443, get no ALPN at all instead of a failed handshake.
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		var protos []string
+		if p.HTTP2 && contains(hello.SupportedProtos, alpnH2) {
+			protos = append(protos, alpnH2)
+		}
+		if contains(hello.SupportedProtos, alpnHTTP11) {
+			protos = append(protos, alpnHTTP11)
+		}
+		if protos == nil {
+			return nil, nil
+		}
+		withALPN := config.Clone()
+		withALPN.GetConfigForClient = nil
+		withALPN.NextProtos = protos
+		return withALPN, nil
+	}
+	return config
+}
+
+type tlsSettingsJSON struct {
+	MinVersion   string   `json:"minVersion,omitempty"`
+	MaxVersion   string   `json:"maxVersion,omitempty"`
+	CipherSuites []string `json:"cipherSuites,omitempty"`
+
+	// Only for servers.
+	CAFile             string   `json:"caFile,omitempty"`
+	Pins               []string `json:"pins,omitempty"`
+	InsecureSkipVerify *bool    `json:"insecureSkipVerify,omitempty"`
+	OnVerifyFailure    string   `json:"onVerifyFailure,omitempty"`
+}
+
+type tlsConfigJSON struct {
+	Client    tlsSettingsJSON            `json:"client"`
+	Listeners map[string]tlsSettingsJSON `json:"listeners"` // by port
+	Upstream  tlsSettingsJSON            `json:"upstream"`
+	Hosts     map[string]tlsSettingsJSON `json:"hosts"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, errors.New("Unknown TLS version " + version + ", use 1.0, 1.1, 1.2 or 1.3")
+}
+
+// parseCipherSuite takes the names Go uses, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+// the insecure ones too.
+func parseCipherSuite(name string) (uint16, error) {
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, suite := range suites {
+		if suite.Name != name {
+			continue
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return 0, errors.New("TLS 1.3 cipher suites cannot be chosen: " + name)
+		}
+		return suite.ID, nil
+	}
+	return 0, errors.New("Unknown cipher suite " + name)
+}
+
+// loadCAFile returns the system roots with the certificates in the PEM file
+// at path.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(path + " has no PEM certificates")
+	}
+	return pool, nil
+}
+
+// parsePin takes "sha256/" and the base64 of the hash, like in HPKP.
+func parsePin(pin string) ([]byte, error) {
+	if !strings.HasPrefix(pin, "sha256/") {
+		return nil, errors.New("Pins start with sha256/: " + pin)
+	}
+	hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+	if err != nil || len(hash) != 32 {
+		return nil, errors.New("Pins are sha256/ and the base64 of a SHA-256 hash: " + pin)
+	}
+	return hash, nil
+}
+
+func (settingsJSON tlsSettingsJSON) compile(upstream bool) (TLSSettings, error) {
+	var settings TLSSettings
+	var err error
+	if settings.MinVersion, err = parseTLSVersion(settingsJSON.MinVersion); err != nil {
+		return settings, err
+	}
+	if settings.MaxVersion, err = parseTLSVersion(settingsJSON.MaxVersion); err != nil {
+		return settings, err
+	}
+	if settings.MaxVersion != 0 && settings.MinVersion > settings.MaxVersion {
+		return settings, errors.New("minVersion is newer than maxVersion")
+	}
+	for _, name := range settingsJSON.CipherSuites {
+		suite, err := parseCipherSuite(name)
+		if err != nil {
+			return settings, err
+		}
+		settings.CipherSuites = append(settings.CipherSuites, suite)
+	}
+
+	if !upstream {
+		if settingsJSON.CAFile != "" || settingsJSON.Pins != nil || settingsJSON.InsecureSkipVerify != nil || settingsJSON.OnVerifyFailure != "" {
+			return settings, errors.New("caFile, pins, insecureSkipVerify and onVerifyFailure are only for servers")
+		}
+		return settings, nil
+	}
+	if settingsJSON.CAFile != "" {
+		if settings.RootCAs, err = loadCAFile(settingsJSON.CAFile); err != nil {
+			return settings, err
+		}
+	}
+	for _, pin := range settingsJSON.Pins {
+		hash, err := parsePin(pin)
+		if err != nil {
+			return settings, err
+		}
+		settings.Pins = append(settings.Pins, hash)
+	}
+	settings.InsecureSkipVerify = settingsJSON.InsecureSkipVerify
+	switch settingsJSON.OnVerifyFailure {
+	case "", VerifyFailureBlock, VerifyFailureUntrusted:
+		settings.OnVerifyFailure = settingsJSON.OnVerifyFailure
+	default:
+		return settings, errors.New("onVerifyFailure is " + VerifyFailureBlock + " or " + VerifyFailureUntrusted)
+	}
+	return settings, nil
+}
+
+func compileTLSPolicy(defaultJSON tlsSettingsJSON, byNameJSON map[string]tlsSettingsJSON, upstream bool) (TLSPolicy, error) {
+	var policy TLSPolicy
+	var err error
+	if policy.Default, err = defaultJSON.compile(upstream); err != nil {
+		return policy, err
+	}
+	policy.ByName = make(map[string]TLSSettings)
+	for name, settingsJSON := range byNameJSON {
+		if policy.ByName[name], err = settingsJSON.compile(upstream); err != nil {
+			return policy, errors.New(name + ": " + err.Error())
+		}
+	}
+	return policy, nil
+}
+
+// LoadTLSConfig reads the TLS settings of the client leg, by listener port,
+// and of the upstream leg, by server host, from a JSON file. Relative
+// caFile paths are relative to the working directory.
+func LoadTLSConfig(path string) (client TLSPolicy, upstream TLSPolicy, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return client, upstream, err
+	}
+	defer file.Close()
+	var configJSON tlsConfigJSON
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&configJSON); err != nil {
+		return client, upstream, errors.New(path + ": " + err.Error())
+	}
+	if client, err = compileTLSPolicy(configJSON.Client, configJSON.Listeners, false); err != nil {
+		return client, upstream, errors.New(path + ": client: " + err.Error())
+	}
+	if upstream, err = compileTLSPolicy(configJSON.Upstream, configJSON.Hosts, true); err != nil {
+		return client, upstream, errors.New(path + ": upstream: " + err.Error())
+	}
+	return client, upstream, nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestTLSPolicySettings(t *testing.T) {
+	policy := &TLSPolicy{
+		Default: TLSSettings{MinVersion: tls.VersionTLS12},
+		ByName: map[string]TLSSettings{
+			"example.com":   {MaxVersion: tls.VersionTLS12},
+			"*.example.com": {MinVersion: tls.VersionTLS13},
+		},
+	}
+	tests := []struct {
+		name     string
+		min, max uint16
+	}{
+		{"example.com", tls.VersionTLS12, tls.VersionTLS12},
+		{"a.b.example.com", tls.VersionTLS13, 0},
+		{"example.org", tls.VersionTLS12, 0},
+	}
+	for _, test := range tests {
+		settings := policy.Settings(test.name)
+		if settings.MinVersion != test.min || settings.MaxVersion != test.max {
+			t.Errorf("%s gave %x-%x", test.name, settings.MinVersion, settings.MaxVersion)
+		}
+	}
+	var none *TLSPolicy
+	if settings := none.Settings("example.com"); settings.MinVersion != 0 || settings.CipherSuites != nil {
+		t.Errorf("nil policy gave %v", settings)
+	}
+}
+
+func TestTLSSettingsCompile(t *testing.T) {
+	tests := []struct {
+		settings tlsSettingsJSON
+		ok       bool
+	}{
+		{tlsSettingsJSON{MinVersion: "1.2", MaxVersion: "1.3"}, true},
+		{tlsSettingsJSON{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"}}, true},
+		{tlsSettingsJSON{MinVersion: "1.3", MaxVersion: "1.2"}, false},
+		{tlsSettingsJSON{MinVersion: "TLSv1.2"}, false},
+		{tlsSettingsJSON{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}, false},
+		{tlsSettingsJSON{CipherSuites: []string{"RC4"}}, false},
+	}
+	for _, test := range tests {
+		if _, err := test.settings.compile(true); (err == nil) != test.ok {
+			t.Errorf("%v gave %v", test.settings, err)
+		}
+	}
+}
+
+func TestTLSSettingsCompileUpstreamOnly(t *testing.T) {
+	skip := true
+	tests := []struct {
+		settings tlsSettingsJSON
+		ok       bool
+	}{
+		{tlsSettingsJSON{Pins: []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}, true},
+		{tlsSettingsJSON{Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}, false},
+		{tlsSettingsJSON{Pins: []string{"sha256/AAAA"}}, false},
+		{tlsSettingsJSON{InsecureSkipVerify: &skip, OnVerifyFailure: VerifyFailureUntrusted}, true},
+		{tlsSettingsJSON{OnVerifyFailure: "allow"}, false},
+		{tlsSettingsJSON{CAFile: "missing.pem"}, false},
+	}
+	for _, test := range tests {
+		if _, err := test.settings.compile(true); (err == nil) != test.ok {
+			t.Errorf("%v gave %v", test.settings, err)
+		}
+	}
+	if _, err := (tlsSettingsJSON{InsecureSkipVerify: &skip}).compile(false); err == nil {
+		t.Error("insecureSkipVerify was taken for clients")
+	}
+}
+
+func TestClientALPN(t *testing.T) {
+	tests := []struct {
+		http2  bool
+		offers []string
+		protos []string
+	}{
+		{true, []string{"h2", "http/1.1"}, []string{"h2", "http/1.1"}},
+		{false, []string{"h2", "http/1.1"}, []string{"http/1.1"}},
+		{true, []string{"http/1.1"}, []string{"http/1.1"}},
+		{true, []string{"spdy/3"}, nil},
+		{true, nil, nil},
+	}
+	for _, test := range tests {
+		p := &proxy{HTTP2: test.http2}
+		config := p.clientTLSConfig(tls.Certificate{}, "443")
+		chosen, err := config.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: test.offers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var protos []string
+		if chosen != nil {
+			protos = chosen.NextProtos
+		}
+		if strings.Join(protos, ",") != strings.Join(test.protos, ",") {
+			t.Errorf("http2 %v, offers %v gave %v", test.http2, test.offers, protos)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"html"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CertificateError is returned when the certificate of a server cannot be
+// trusted.
+type CertificateError struct {
+	Host string
+	Err  error
+}
+
+func (e *CertificateError) Error() string {
+	return "certificate of " + e.Host + " is not trusted: " + e.Err.Error()
+}
+
+func isCertificateError(err error) bool {
+	var certErr *CertificateError
+	return errors.As(err, &certErr)
+}
+
+// verify checks the certificates the server at host sent.
+func (settings TLSSettings) verify(host string, state tls.ConnectionState) error {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return &CertificateError{host, errors.New("no certificate")}
+	}
+	chains := [][]*x509.Certificate{certs}
+	if settings.InsecureSkipVerify == nil || !*settings.InsecureSkipVerify {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		var err error
+		chains, err = certs[0].Verify(x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         settings.RootCAs,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return &CertificateError{host, err}
+		}
+	}
+	if len(settings.Pins) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range settings.Pins {
+				if bytes.Equal(hash[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return &CertificateError{host, errors.New("no certificate has a pinned key")}
+}
+
+// CertificateErrorResponse returns the error page sent to the client instead
+// of the response of a server that is not trusted, or nil if err is not a
+// CertificateError.
+func CertificateErrorResponse(req *http.Request, err error) *http.Response {
+	var certErr *CertificateError
+	if !errors.As(err, &certErr) {
+		return nil
+	}
+	body := "<!DOCTYPE html>\n<title>Untrusted server</title>\n" +
+		"<h1>The certificate of " + html.EscapeString(certErr.Host) + " is not trusted</h1>\n" +
+		"<p>" + html.EscapeString(certErr.Err.Error()) + "</p>\n" +
+		"<p>The proxy did not send the request.</p>\n"
+	resp := NewResponse(req)
+	resp.StatusCode = http.StatusBadGateway
+	resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Body = ioutil.NopCloser(bytes.NewReader([]byte(body)))
+	return resp
+}
+
+var untrustedCA tls.Certificate
+var untrustedCAErr error
+var untrustedCAOnce sync.Once
+
+// getUntrustedCA returns a CA made when it is first needed, that nobody
+// trusts, for the certificates of VerifyFailureUntrusted.
+func getUntrustedCA() (tls.Certificate, error) {
+	untrustedCAOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			untrustedCAErr = err
+			return
+		}
+		template := x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject: pkix.Name{
+				Organization: []string{"RESTful HTTPS Proxy untrusted CA"},
+				CommonName:   "RESTful HTTPS Proxy untrusted CA",
+			},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().AddDate(10, 0, 0),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+		if err != nil {
+			untrustedCAErr = err
+			return
+		}
+		untrustedCA = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	})
+	return untrustedCA, untrustedCAErr
+}
+
+// checkUpstream connects to the server at hostAndPort to tell if its
+// certificate is trusted, only a CertificateError means it is not.
+func checkUpstream(hostAndPort string, settings TLSSettings) error {
+	host, _ := SplitHostAndPort(hostAndPort)
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{alpnHTTP11},
+	}
+	settings.apply(config)
+	server, err := tls.DialWithDialer(dialer, "tcp", hostAndPort, config)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	return settings.verify(host, server.ConnectionState())
+}
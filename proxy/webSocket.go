@@ -0,0 +1,317 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WebSocket opcodes of data frames, see RFC 6455 section 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+)
+
+// Messages are put together before the rules see them, bigger ones close
+// the WebSocket.
+const maxWebSocketMessageSize = 16 << 20
+
+var errWebSocketMessageTooBig = errors.New("WebSocket message too big")
+
+// WebSocketMessage is a text or binary message of a WebSocket.
+type WebSocketMessage struct {
+	FromClient bool // sent by the client, or to be sent to the server
+	Binary     bool
+	Data       []byte
+}
+
+// WebSocketHandler sees the messages of a WebSocket, see
+// ClientConnProps.HandleWebSocket. Message is called by one goroutine for
+// each direction, so it must be safe for concurrent use.
+type WebSocketHandler interface {
+	// Opened returns the messages to send once the WebSocket is open.
+	Opened() []WebSocketMessage
+	// Message returns the messages to send instead of message, those with
+	// FromClient go to the server and the others to the client.
+	Message(message WebSocketMessage) []WebSocketMessage
+	// Closed is called once, when the WebSocket is closed or when the
+	// server did not switch to it.
+	Closed()
+}
+
+// IsWebSocket tells if header asks for, or switches to, a WebSocket.
+func IsWebSocket(header http.Header) bool {
+	return headerHasToken(header, "Upgrade", "websocket")
+}
+
+// headerHasToken tells if one of the comma separated values of key is token.
+func headerHasToken(header http.Header, key string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(key)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type wsFrame struct {
+	fin     bool
+	rsv     byte // the RSV1-3 bits, set by extensions
+	opcode  byte
+	payload []byte
+}
+
+func (f *wsFrame) isControl() bool {
+	return f.opcode&0x8 != 0
+}
+
+func readWSFrame(r io.Reader) (*wsFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	f := &wsFrame{
+		fin:    head[0]&0x80 != 0,
+		rsv:    head[0] & 0x70,
+		opcode: head[0] & 0x0f,
+	}
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketMessageSize {
+		return nil, errWebSocketMessageTooBig
+	}
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskWSPayload(f.payload, key)
+	}
+	return f, nil
+}
+
+func maskWSPayload(payload []byte, key [4]byte) {
+	for i := range payload {
+		payload[i] ^= key[i%4]
+	}
+}
+
+// wsWriter writes whole frames to one side of a WebSocket, frames that go to
+// a server are masked like the client would have.
+type wsWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	mask bool
+}
+
+func (ww *wsWriter) write(f *wsFrame) error {
+	header := make([]byte, 2, 14)
+	header[0] = f.rsv | f.opcode
+	if f.fin {
+		header[0] |= 0x80
+	}
+	length := len(f.payload)
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	payload := f.payload
+	if ww.mask {
+		header[1] |= 0x80
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		header = append(header, key[:]...)
+		payload = append([]byte(nil), payload...)
+		maskWSPayload(payload, key)
+	}
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	_, err := ww.w.Write(append(header, payload...))
+	return err
+}
+
+func (ww *wsWriter) writeMessage(message WebSocketMessage) error {
+	f := &wsFrame{fin: true, opcode: wsText, payload: message.Data}
+	if message.Binary {
+		f.opcode = wsBinary
+	}
+	return ww.write(f)
+}
+
+// upgradedConn is a server connection that switched protocols, what the
+// server sent right after its 101 may already be in r.
+type upgradedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// relayWebSocket passes the frames of a WebSocket between client and server
+// until one of them closes it. Control frames are passed on as they come,
+// data frames are put together into messages for handler. Messages that use
+// an extension, which the RSV bits tell, are passed on as they are since
+// their data cannot be read.
+func relayWebSocket(client net.Conn, server net.Conn, handler WebSocketHandler) {
+	defer handler.Closed()
+	toClient := &wsWriter{w: client}
+	toServer := &wsWriter{w: server, mask: true}
+	send := func(messages []WebSocketMessage) error {
+		for _, message := range messages {
+			w := toClient
+			if message.FromClient {
+				w = toServer
+			}
+			if err := w.writeMessage(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	closeBoth := func() {
+		client.Close()
+		server.Close()
+	}
+	if err := send(handler.Opened()); err != nil {
+		closeBoth()
+		return
+	}
+
+	pump := func(src io.Reader, dst *wsWriter, fromClient bool) {
+		defer closeBoth()
+		var message *WebSocketMessage
+		opaque := false
+		for {
+			f, err := readWSFrame(src)
+			if err != nil {
+				return
+			}
+			if f.isControl() {
+				if err := dst.write(f); err != nil {
+					return
+				}
+				continue
+			}
+			if f.opcode != wsContinuation {
+				opaque = f.rsv != 0
+				message = &WebSocketMessage{FromClient: fromClient, Binary: f.opcode == wsBinary}
+			}
+			if opaque || message == nil {
+				if err := dst.write(f); err != nil {
+					return
+				}
+				continue
+			}
+			if len(message.Data)+len(f.payload) > maxWebSocketMessageSize {
+				return
+			}
+			message.Data = append(message.Data, f.payload...)
+			if !f.fin {
+				continue
+			}
+			if err := send(handler.Message(*message)); err != nil {
+				return
+			}
+			message = nil
+		}
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		pump(client, toServer, true)
+		wg.Done()
+	}()
+	go func() {
+		pump(server, toClient, false)
+		wg.Done()
+	}()
+	wg.Wait()
+}
+
+// HandleWebSocket makes handler see the messages of the WebSocket the
+// current request opens, if the server switches to it.
+func (client *ClientConnProps) HandleWebSocket(handler WebSocketHandler) {
+	client.webSocket = handler
+}
+
+// switchProtocols sends the 101 of the server to the client and then passes
+// on what both sides send, until one of them closes the connection.
+func (client *ClientConnProps) switchProtocols(resp *http.Response, server net.Conn) {
+	handler := client.webSocket
+	client.webSocket = nil
+	resp.Body = nil
+	resp.ContentLength = 0
+	if err := resp.Write(client.Conn); err != nil {
+		server.Close()
+		if handler != nil {
+			handler.Closed()
+		}
+		return
+	}
+	if handler != nil && IsWebSocket(resp.Header) {
+		relayWebSocket(client.Conn, server, handler)
+		return
+	}
+	if handler != nil {
+		handler.Closed()
+	}
+	doubleSidedCopy(client.Conn, server)
+	server.Close()
+}
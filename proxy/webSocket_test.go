@@ -0,0 +1,56 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestWSFrames(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 70000} {
+		for _, mask := range []bool{false, true} {
+			var buf bytes.Buffer
+			payload := bytes.Repeat([]byte("ab"), size)[:size]
+			ww := &wsWriter{w: &buf, mask: mask}
+			if err := ww.write(&wsFrame{fin: true, opcode: wsBinary, payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+			if mask && size > 0 && bytes.Contains(buf.Bytes(), payload) {
+				t.Errorf("size %d: payload is not masked", size)
+			}
+			f, err := readWSFrame(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !f.fin || f.opcode != wsBinary || !bytes.Equal(f.payload, payload) {
+				t.Errorf("size %d, mask %v: got fin %v, opcode %d and %d bytes", size, mask, f.fin, f.opcode, len(f.payload))
+			}
+		}
+	}
+}
+
+func TestIsWebSocket(t *testing.T) {
+	header := http.Header{"Upgrade": {"h2c, WebSocket"}}
+	if !IsWebSocket(header) {
+		t.Error("websocket not found in Upgrade")
+	}
+	if IsWebSocket(http.Header{"Upgrade": {"websockets"}}) {
+		t.Error("websockets taken for websocket")
+	}
+}
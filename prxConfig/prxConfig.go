@@ -20,8 +20,14 @@ import (
 	// "bytes"
 	// "io"
 	// "io/ioutil"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"net/http"
+	"path/filepath"
 	"regexp"
+	"restfulHttpsProxy/jsonPath"
+	"strings"
 )
 
 type Rule struct {
@@ -32,11 +38,39 @@ type Rule struct {
 
 	Append *string
 	//no delete, replace with ""
+
+	// JSON rules, only for bodies.
+	JSONSet    *jsonPath.Path
+	Value      interface{}
+	JSONDelete *jsonPath.Path
+	JSONMerge  interface{}
+	JSONPatch  []PatchOp
+}
+
+// IsJSON tells if the rule edits a JSON document.
+func (rule *Rule) IsJSON() bool {
+	return rule.JSONSet != nil || rule.JSONDelete != nil || rule.JSONMerge != nil || rule.JSONPatch != nil
+}
+
+// PatchOp is a JSON Patch (RFC 6902) operation.
+type PatchOp struct {
+	Op    string
+	Path  *jsonPath.Path
+	From  *jsonPath.Path
+	Value interface{}
+}
+
+type PatchOpJSON struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  *string         `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
 }
 
 type Config struct {
-	IP    *string     `json:"ip,omitempty"`
-	Rules []EntryJSON `json:"rules,omitempty"`
+	Session *string     `json:"session,omitempty"` // session key, the ip of the client by default
+	IP      *string     `json:"ip,omitempty"`      // older name of Session
+	Rules   []EntryJSON `json:"rules"`
 }
 
 type RuleJSON struct {
@@ -45,20 +79,54 @@ type RuleJSON struct {
 	Append  *string `json:"append,omitempty"`
 	Prepend *string `json:"prepend,omitempty"`
 	Delete  *string `json:"delete,omitempty"`
+
+	JSONSet    *string         `json:"jsonSet,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	JSONDelete *string         `json:"jsonDelete,omitempty"`
+	JSONMerge  json.RawMessage `json:"jsonMerge,omitempty"`
+	JSONPatch  []PatchOpJSON   `json:"jsonPatch,omitempty"`
+}
+
+func (ruleJSON *RuleJSON) isJSON() bool {
+	return ruleJSON.JSONSet != nil || ruleJSON.JSONDelete != nil || ruleJSON.JSONMerge != nil || ruleJSON.JSONPatch != nil
+}
+
+// HeaderOpJSON is an edit of a single named header.
+// Op is one of set, add, remove, rename and replace.
+type HeaderOpJSON struct {
+	Op      string  `json:"op"`
+	Name    string  `json:"name"`
+	Value   *string `json:"value,omitempty"`
+	To      *string `json:"to,omitempty"`
+	Find    *string `json:"find,omitempty"`
+	Replace *string `json:"replace,omitempty"`
+}
+
+type HeaderOp struct {
+	Op      string
+	Name    string // canonical
+	Value   string
+	To      string
+	Find    *regexp.Regexp
+	Replace string
 }
 
 type TypeJSON struct {
-	URL    []RuleJSON `json:"url,omitempty"`
-	Header []RuleJSON `json:"header,omitempty"`
-	Body   []RuleJSON `json:"body,omitempty"`
-	Status []RuleJSON `json:"status,omitempty"`
+	URL       []RuleJSON     `json:"url,omitempty"`
+	Header    []RuleJSON     `json:"header,omitempty"`
+	HeaderOps []HeaderOpJSON `json:"headerOps,omitempty"`
+	Body      []RuleJSON     `json:"body,omitempty"`
+	Events    []RuleJSON     `json:"events,omitempty"` // on the data of every server-sent event, responses only
+	Status    []RuleJSON     `json:"status,omitempty"`
 }
 
 type Type struct {
-	URL    []Rule
-	Header []Rule
-	Body   []Rule
-	Status []Rule
+	URL       []Rule
+	Header    []Rule
+	HeaderOps []HeaderOp
+	Body      []Rule
+	Events    []Rule
+	Status    []Rule
 }
 
 type WhereJSON struct {
@@ -71,45 +139,247 @@ type Where struct {
 	Response *Type
 }
 
+// RespondJSON describes a canned response that is served instead of
+// contacting the server. Only one of Body, BodyBase64 and File can be set.
+type RespondJSON struct {
+	Status     *int              `json:"status,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       *string           `json:"body,omitempty"`
+	BodyBase64 *string           `json:"bodyBase64,omitempty"`
+	File       *string           `json:"file,omitempty"`
+}
+
+// Respond is a compiled RespondJSON, if File is set the body is read from it
+// every time the response is served. File is relative to the directory of the
+// responses, it cannot leave it.
+type Respond struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	File   string
+}
+
+// FaultJSON describes network faults to simulate. Only one of ResetAfter,
+// TruncateAfter and Hang can be set.
+type FaultJSON struct {
+	ResetAfter    *int64   `json:"resetAfter,omitempty"`
+	TruncateAfter *int64   `json:"truncateAfter,omitempty"`
+	Hang          *bool    `json:"hang,omitempty"`
+	ErrorRate     *float64 `json:"errorRate,omitempty"`
+	ErrorStatus   *int     `json:"errorStatus,omitempty"`
+	DropFirst     *uint64  `json:"dropFirst,omitempty"`
+}
+
+type Fault struct {
+	ResetAfter    *int64
+	TruncateAfter *int64
+	Hang          bool
+	ErrorRate     float64
+	ErrorStatus   int
+	DropFirst     uint64
+}
+
+// WebSocketJSON holds rules for the messages of WebSockets that requests
+// matching the entry open.
+type WebSocketJSON struct {
+	Open       []WebSocketMessageJSON `json:"open,omitempty"`
+	FromClient []WebSocketRuleJSON    `json:"fromClient,omitempty"`
+	FromServer []WebSocketRuleJSON    `json:"fromServer,omitempty"`
+}
+
+// WebSocketRuleJSON acts on the messages Find matches, or on all of them if
+// Find is not set. Replace needs Find.
+type WebSocketRuleJSON struct {
+	Find    *string                `json:"find,omitempty"`
+	Replace *string                `json:"replace,omitempty"`
+	Drop    *bool                  `json:"drop,omitempty"`
+	Inject  []WebSocketMessageJSON `json:"inject,omitempty"`
+}
+
+// WebSocketMessageJSON is a message sent by the proxy, To is "client" or
+// "server". Injected messages go where the matched message goes unless To is
+// set. Only one of Text and Base64 can be set, Base64 makes a binary message.
+type WebSocketMessageJSON struct {
+	To     *string `json:"to,omitempty"`
+	Text   *string `json:"text,omitempty"`
+	Base64 *string `json:"base64,omitempty"`
+}
+
+type WebSocket struct {
+	Open       []WebSocketMessage
+	FromClient []WebSocketRule
+	FromServer []WebSocketRule
+}
+
+type WebSocketRule struct {
+	Find    *regexp.Regexp
+	Replace *string
+	Drop    bool
+	Inject  []WebSocketMessage
+}
+
+// WebSocketMessage is a compiled WebSocketMessageJSON, To is empty if it
+// was not set.
+type WebSocketMessage struct {
+	To     string
+	Binary bool
+	Data   []byte
+}
+
+// MatchJSON holds conditions on the request that must all be true.
+// The strings are regexes, except for the JSONPath keys.
+type MatchJSON struct {
+	Method     *string           `json:"method,omitempty"`
+	URL        *string           `json:"url,omitempty"`
+	Header     map[string]string `json:"header,omitempty"`
+	Query      map[string]string `json:"query,omitempty"`
+	Body       *string           `json:"body,omitempty"`
+	JSONPath   map[string]string `json:"jsonPath,omitempty"`
+	ClientPort *string           `json:"clientPort,omitempty"`
+
+	And []MatchJSON `json:"and,omitempty"`
+	Or  []MatchJSON `json:"or,omitempty"`
+	Not *MatchJSON  `json:"not,omitempty"`
+}
+
+type JSONPathMatch struct {
+	Path  *jsonPath.Path
+	Value *regexp.Regexp
+}
+
+type Match struct {
+	Method     *regexp.Regexp
+	URL        *regexp.Regexp
+	Header     map[string]*regexp.Regexp
+	Query      map[string]*regexp.Regexp
+	Body       *regexp.Regexp
+	JSONPath   []JSONPathMatch
+	ClientPort *regexp.Regexp
+
+	And []Match
+	Or  []Match
+	Not *Match
+}
+
+// NeedsBody tells if the request body is needed to check the match.
+func (m *Match) NeedsBody() bool {
+	if m == nil {
+		return false
+	}
+	if m.Body != nil || len(m.JSONPath) > 0 || m.Not.NeedsBody() {
+		return true
+	}
+	for i := range m.And {
+		if m.And[i].NeedsBody() {
+			return true
+		}
+	}
+	for i := range m.Or {
+		if m.Or[i].NeedsBody() {
+			return true
+		}
+	}
+	return false
+}
+
 type EntryJSON struct {
+	ID       string `json:"id,omitempty"`
+	Disabled *bool  `json:"disabled,omitempty"`
+
 	URL           *string `json:"url,omitempty"`
 	UploadSpeed   *uint64 `json:"uploadSpeed,omitempty"`
 	DownloadSpeed *uint64 `json:"downloadSpeed,omitempty"`
 	ResponseDelay *uint64 `json:"responseDelay,omitempty"`
+	// Sends the response to the client as it comes, like server-sent
+	// events always are.
+	Streaming *bool `json:"streaming,omitempty"`
+
+	Match   *MatchJSON   `json:"match,omitempty"`
+	Respond *RespondJSON `json:"respond,omitempty"`
+	Fault   *FaultJSON   `json:"fault,omitempty"`
+	Rewrite *WhereJSON   `json:"rewrite,omitempty"`
 
-	Rewrite *WhereJSON `json:"rewrite,omitempty"`
+	WebSocket *WebSocketJSON `json:"webSocket,omitempty"`
 }
 
 type Entry struct {
+	ID string
+
 	URL           *regexp.Regexp
 	UploadSpeed   *uint64
 	DownloadSpeed *uint64
 	ResponseDelay *uint64
+	Streaming     bool
 
+	Match   *Match
+	Respond *Respond
+	Fault   *Fault
 	Rewrite *Where
+
+	WebSocket *WebSocket
 }
 
 // type RewriteRulesJSON []EntryJSON
 type RewriteRules []Entry
 
+// NeedsRequestBody tells if the request body is needed to find the matching entries.
+func (rules RewriteRules) NeedsRequestBody() bool {
+	for i := range rules {
+		if rules[i].Match.NeedsBody() {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAll is the url of rules that have none.
+var matchAll = regexp.MustCompile(".*")
+
+// Compile compiles the rules of configJSON, disabled rules are checked but
+// left out of the result. Errors are *ConfigError, telling where the problem is.
 func Compile(configJSON Config) (RewriteRules, error) {
 
 	rewriteRulesJSON := configJSON.Rules
 	var rewriteRules RewriteRules
 	var err error
-	for _, entryJSON := range rewriteRulesJSON {
-		entry := Entry{}
+	for i, entryJSON := range rewriteRulesJSON {
+		entry := Entry{ID: entryJSON.ID}
 		if entryJSON.URL != nil {
 			entry.URL, err = regexp.Compile(*entryJSON.URL)
 			if err != nil {
-				return nil, err
+				return nil, at(err, "rules", i, "url")
 			}
 		} else {
-			entry.URL, err = regexp.Compile(".*")
+			entry.URL = matchAll
 		}
 		entry.DownloadSpeed = entryJSON.DownloadSpeed
 		entry.UploadSpeed = entryJSON.UploadSpeed
 		entry.ResponseDelay = entryJSON.ResponseDelay
+		entry.Streaming = entryJSON.Streaming != nil && *entryJSON.Streaming
+		if entryJSON.Match != nil {
+			entry.Match, err = compileMatch(entryJSON.Match)
+			if err != nil {
+				return nil, at(err, "rules", i, "match")
+			}
+		}
+		if entryJSON.Respond != nil {
+			entry.Respond, err = compileRespond(entryJSON.Respond)
+			if err != nil {
+				return nil, at(err, "rules", i, "respond")
+			}
+		}
+		if entryJSON.Fault != nil {
+			entry.Fault, err = compileFault(entryJSON.Fault)
+			if err != nil {
+				return nil, at(err, "rules", i, "fault")
+			}
+		}
+		if entryJSON.WebSocket != nil {
+			entry.WebSocket, err = compileWebSocket(entryJSON.WebSocket)
+			if err != nil {
+				return nil, at(err, "rules", i, "webSocket")
+			}
+		}
 		if entryJSON.Rewrite == nil {
 			entryJSON.Rewrite = &WhereJSON{}
 		}
@@ -122,79 +392,469 @@ func Compile(configJSON Config) (RewriteRules, error) {
 		}
 		entry.Rewrite.Request, err = compileTypes(entryJSON.Rewrite.Request)
 		if err != nil {
-			return nil, err
+			return nil, at(err, "rules", i, "rewrite", "request")
+		}
+		if len(entry.Rewrite.Request.Events) > 0 {
+			return nil, at(errors.New("events rules are only for responses"), "rules", i, "rewrite", "request", "events")
 		}
 		entry.Rewrite.Response, err = compileTypes(entryJSON.Rewrite.Response)
 		if err != nil {
-			return nil, err
+			return nil, at(err, "rules", i, "rewrite", "response")
+		}
+		if entryJSON.Disabled != nil && *entryJSON.Disabled {
+			continue
 		}
 		rewriteRules = append(rewriteRules, entry)
 	}
 	return rewriteRules, nil
 }
 
+func compileRegexMap(regexesJSON map[string]string) (map[string]*regexp.Regexp, error) {
+	if regexesJSON == nil {
+		return nil, nil
+	}
+	regexes := make(map[string]*regexp.Regexp)
+	for key, regexJSON := range regexesJSON {
+		regex, err := regexp.Compile(regexJSON)
+		if err != nil {
+			return nil, at(err, key)
+		}
+		regexes[key] = regex
+	}
+	return regexes, nil
+}
+
+func compileOptionalRegex(regexJSON *string) (*regexp.Regexp, error) {
+	if regexJSON == nil {
+		return nil, nil
+	}
+	return regexp.Compile(*regexJSON)
+}
+
+func compileMatch(matchJSON *MatchJSON) (*Match, error) {
+	var match Match
+	var err error
+	if match.Method, err = compileOptionalRegex(matchJSON.Method); err != nil {
+		return nil, at(err, "method")
+	}
+	if match.URL, err = compileOptionalRegex(matchJSON.URL); err != nil {
+		return nil, at(err, "url")
+	}
+	if match.Body, err = compileOptionalRegex(matchJSON.Body); err != nil {
+		return nil, at(err, "body")
+	}
+	if match.ClientPort, err = compileOptionalRegex(matchJSON.ClientPort); err != nil {
+		return nil, at(err, "clientPort")
+	}
+	if match.Header, err = compileRegexMap(matchJSON.Header); err != nil {
+		return nil, at(err, "header")
+	}
+	if match.Query, err = compileRegexMap(matchJSON.Query); err != nil {
+		return nil, at(err, "query")
+	}
+	for pathJSON, valueJSON := range matchJSON.JSONPath {
+		path, err := jsonPath.Parse(pathJSON)
+		if err != nil {
+			return nil, at(err, "jsonPath", pathJSON)
+		}
+		value, err := regexp.Compile(valueJSON)
+		if err != nil {
+			return nil, at(err, "jsonPath", pathJSON)
+		}
+		match.JSONPath = append(match.JSONPath, JSONPathMatch{Path: path, Value: value})
+	}
+	for i := range matchJSON.And {
+		and, err := compileMatch(&matchJSON.And[i])
+		if err != nil {
+			return nil, at(err, "and", i)
+		}
+		match.And = append(match.And, *and)
+	}
+	for i := range matchJSON.Or {
+		or, err := compileMatch(&matchJSON.Or[i])
+		if err != nil {
+			return nil, at(err, "or", i)
+		}
+		match.Or = append(match.Or, *or)
+	}
+	if matchJSON.Not != nil {
+		if match.Not, err = compileMatch(matchJSON.Not); err != nil {
+			return nil, at(err, "not")
+		}
+	}
+	return &match, nil
+}
+
+func compileRespond(respondJSON *RespondJSON) (*Respond, error) {
+	respond := Respond{
+		Status: http.StatusOK,
+		Header: make(http.Header),
+	}
+	if respondJSON.Status != nil {
+		if *respondJSON.Status < 100 || *respondJSON.Status > 999 {
+			return nil, at(errors.New("Illegal status, must be between 100 and 999"), "status")
+		}
+		respond.Status = *respondJSON.Status
+	}
+	for key, value := range respondJSON.Headers {
+		respond.Header.Set(key, value)
+	}
+	bodies := 0
+	if respondJSON.Body != nil {
+		bodies++
+		respond.Body = []byte(*respondJSON.Body)
+	}
+	if respondJSON.BodyBase64 != nil {
+		bodies++
+		body, err := base64.StdEncoding.DecodeString(*respondJSON.BodyBase64)
+		if err != nil {
+			return nil, at(err, "bodyBase64")
+		}
+		respond.Body = body
+	}
+	if respondJSON.File != nil {
+		bodies++
+		// Only the path is checked here, the file may come later and the
+		// rules of a session are compiled again when the proxy starts.
+		file := filepath.Clean(*respondJSON.File)
+		if filepath.IsAbs(file) || file == ".." || strings.HasPrefix(file, ".."+string(filepath.Separator)) {
+			return nil, at(errors.New("Illegal file, must be a path inside the responses directory"), "file")
+		}
+		respond.File = file
+	}
+	if bodies > 1 {
+		return nil, errors.New("Illegal field choice in respond, only one of body, bodyBase64 and file can be set")
+	}
+	return &respond, nil
+}
+
+func compileWebSocket(webSocketJSON *WebSocketJSON) (*WebSocket, error) {
+	var webSocket WebSocket
+	for i, messageJSON := range webSocketJSON.Open {
+		if messageJSON.To == nil {
+			return nil, at(errors.New("Illegal open message, to must be client or server"), "open", i)
+		}
+		message, err := compileWebSocketMessage(messageJSON)
+		if err != nil {
+			return nil, at(err, "open", i)
+		}
+		webSocket.Open = append(webSocket.Open, *message)
+	}
+	var err error
+	if webSocket.FromClient, err = compileWebSocketRules(webSocketJSON.FromClient); err != nil {
+		return nil, at(err, "fromClient")
+	}
+	if webSocket.FromServer, err = compileWebSocketRules(webSocketJSON.FromServer); err != nil {
+		return nil, at(err, "fromServer")
+	}
+	return &webSocket, nil
+}
+
+func compileWebSocketRules(rulesJSON []WebSocketRuleJSON) ([]WebSocketRule, error) {
+	var rules []WebSocketRule
+	for i, ruleJSON := range rulesJSON {
+		var rule WebSocketRule
+		var err error
+		if ruleJSON.Find != nil {
+			if rule.Find, err = regexp.Compile(*ruleJSON.Find); err != nil {
+				return nil, at(err, i, "find")
+			}
+		} else if ruleJSON.Replace != nil {
+			return nil, at(errors.New("replace needs find"), i, "replace")
+		}
+		rule.Replace = ruleJSON.Replace
+		rule.Drop = ruleJSON.Drop != nil && *ruleJSON.Drop
+		for j, messageJSON := range ruleJSON.Inject {
+			message, err := compileWebSocketMessage(messageJSON)
+			if err != nil {
+				return nil, at(err, i, "inject", j)
+			}
+			rule.Inject = append(rule.Inject, *message)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func compileWebSocketMessage(messageJSON WebSocketMessageJSON) (*WebSocketMessage, error) {
+	var message WebSocketMessage
+	if messageJSON.To != nil {
+		if *messageJSON.To != "client" && *messageJSON.To != "server" {
+			return nil, at(errors.New("Illegal to, must be client or server"), "to")
+		}
+		message.To = *messageJSON.To
+	}
+	if (messageJSON.Text == nil) == (messageJSON.Base64 == nil) {
+		return nil, errors.New("Illegal field choice in WebSocket message, one of text and base64 must be set")
+	}
+	if messageJSON.Text != nil {
+		message.Data = []byte(*messageJSON.Text)
+	} else {
+		data, err := base64.StdEncoding.DecodeString(*messageJSON.Base64)
+		if err != nil {
+			return nil, at(err, "base64")
+		}
+		message.Binary = true
+		message.Data = data
+	}
+	return &message, nil
+}
+
+func compileFault(faultJSON *FaultJSON) (*Fault, error) {
+	fault := Fault{
+		ErrorStatus: http.StatusServiceUnavailable,
+	}
+	connFaults := 0
+	if faultJSON.ResetAfter != nil {
+		connFaults++
+		if *faultJSON.ResetAfter < 0 {
+			return nil, at(errors.New("Illegal resetAfter, must be 0 or more"), "resetAfter")
+		}
+		fault.ResetAfter = faultJSON.ResetAfter
+	}
+	if faultJSON.TruncateAfter != nil {
+		connFaults++
+		if *faultJSON.TruncateAfter < 0 {
+			return nil, at(errors.New("Illegal truncateAfter, must be 0 or more"), "truncateAfter")
+		}
+		fault.TruncateAfter = faultJSON.TruncateAfter
+	}
+	if faultJSON.Hang != nil && *faultJSON.Hang {
+		connFaults++
+		fault.Hang = true
+	}
+	if connFaults > 1 {
+		return nil, errors.New("Illegal field choice in fault, only one of resetAfter, truncateAfter and hang can be set")
+	}
+	if faultJSON.ErrorRate != nil {
+		if *faultJSON.ErrorRate < 0 || *faultJSON.ErrorRate > 1 {
+			return nil, at(errors.New("Illegal errorRate, must be between 0 and 1"), "errorRate")
+		}
+		fault.ErrorRate = *faultJSON.ErrorRate
+	}
+	if faultJSON.ErrorStatus != nil {
+		if *faultJSON.ErrorStatus < 500 || *faultJSON.ErrorStatus > 599 {
+			return nil, at(errors.New("Illegal errorStatus, must be a 5xx status"), "errorStatus")
+		}
+		fault.ErrorStatus = *faultJSON.ErrorStatus
+	}
+	if faultJSON.DropFirst != nil {
+		fault.DropFirst = *faultJSON.DropFirst
+	}
+	return &fault, nil
+}
+
 func compileTypes(typesJSON *TypeJSON) (*Type, error) {
 	var types Type
 	var err error
-	types.URL, err = compileRules(typesJSON.URL)
+	types.URL, err = compileRules(typesJSON.URL, false)
 	if err != nil {
-		return nil, err
+		return nil, at(err, "url")
+	}
+	types.Header, err = compileRules(typesJSON.Header, false)
+	if err != nil {
+		return nil, at(err, "header")
+	}
+	for i, opJSON := range typesJSON.HeaderOps {
+		op, err := compileHeaderOp(opJSON)
+		if err != nil {
+			return nil, at(err, "headerOps", i)
+		}
+		types.HeaderOps = append(types.HeaderOps, *op)
 	}
-	types.Header, err = compileRules(typesJSON.Header)
+	types.Body, err = compileRules(typesJSON.Body, true)
 	if err != nil {
-		return nil, err
+		return nil, at(err, "body")
 	}
-	types.Body, err = compileRules(typesJSON.Body)
+	types.Events, err = compileRules(typesJSON.Events, true)
 	if err != nil {
-		return nil, err
+		return nil, at(err, "events")
 	}
-	types.Status, err = compileRules(typesJSON.Status)
+	types.Status, err = compileRules(typesJSON.Status, false)
 	if err != nil {
-		return nil, err
+		return nil, at(err, "status")
 	}
 	return &types, nil
 }
 
-func compileRules(rulesJSON []RuleJSON) ([]Rule, error) {
+// The text rules can do one thing each.
+const textRuleChoice = "Illegal field choice in rewrite rule, use one of replace (with an optional find), prepend, append and delete"
+
+func compileRules(rulesJSON []RuleJSON, allowJSON bool) ([]Rule, error) {
 	var err error
 	var rules []Rule
-	for _, ruleJSON := range rulesJSON {
+	for i, ruleJSON := range rulesJSON {
 		rule := Rule{}
+		if ruleJSON.isJSON() {
+			if !allowJSON {
+				return nil, at(errors.New("JSON rules can only be used on the body"), i)
+			}
+			jsonRule, err := compileJSONRule(&ruleJSON)
+			if err != nil {
+				return nil, at(err, i)
+			}
+			rules = append(rules, *jsonRule)
+			continue
+		}
+		if ruleJSON.Value != nil {
+			return nil, at(errors.New("value can only be used with jsonSet"), i, "value")
+		}
 		if ruleJSON.Replace != nil {
 			if ruleJSON.Append != nil || ruleJSON.Prepend != nil || ruleJSON.Delete != nil {
-				return nil, errors.New("Illegal field choice in rewrite rule")
+				return nil, at(errors.New(textRuleChoice), i)
 			}
 			rule.Replace = ruleJSON.Replace
 			if ruleJSON.Find != nil {
 				rule.Find, err = regexp.Compile(*ruleJSON.Find)
 				if err != nil {
-					return nil, err
+					return nil, at(err, i, "find")
 				}
 			}
 		} else if ruleJSON.Prepend != nil {
 			if ruleJSON.Delete != nil || ruleJSON.Find != nil || ruleJSON.Replace != nil || ruleJSON.Append != nil {
-				return nil, errors.New("Illegal field choice in rewrite rule")
+				return nil, at(errors.New(textRuleChoice), i)
 			}
 			rule.Prepend = ruleJSON.Prepend
 		} else if ruleJSON.Append != nil {
 			if ruleJSON.Delete != nil || ruleJSON.Find != nil || ruleJSON.Replace != nil || ruleJSON.Prepend != nil {
-				return nil, errors.New("Illegal field choice in rewrite rule")
+				return nil, at(errors.New(textRuleChoice), i)
 			}
 			rule.Append = ruleJSON.Append
 		} else if ruleJSON.Delete != nil {
 			if ruleJSON.Prepend != nil || ruleJSON.Find != nil || ruleJSON.Replace != nil || ruleJSON.Append != nil {
-				return nil, errors.New("Illegal field choice in rewrite rule")
+				return nil, at(errors.New(textRuleChoice), i)
 			}
 			rule.Find, err = regexp.Compile(*ruleJSON.Delete)
 			if err != nil {
-				return nil, err
+				return nil, at(err, i, "delete")
 			}
 			emptyString := ""
 			rule.Replace = &emptyString
+		} else if ruleJSON.Find != nil {
+			return nil, at(errors.New("find needs a replace"), i)
 		} else {
-			return nil, errors.New("Illegal field choice in rewrite rule")
+			return nil, at(errors.New(textRuleChoice), i)
 		}
 		rules = append(rules, rule)
 	}
 	return rules, nil
 }
+
+func compileJSONRule(ruleJSON *RuleJSON) (*Rule, error) {
+	if ruleJSON.Find != nil || ruleJSON.Replace != nil || ruleJSON.Append != nil || ruleJSON.Prepend != nil || ruleJSON.Delete != nil {
+		return nil, errors.New("Illegal field choice in rewrite rule, JSON rules cannot have find, replace, prepend, append or delete")
+	}
+	kinds := 0
+	var rule Rule
+	var err error
+	if ruleJSON.JSONSet != nil {
+		kinds++
+		if ruleJSON.Value == nil {
+			return nil, errors.New("jsonSet needs a value")
+		}
+		if rule.JSONSet, err = jsonPath.Parse(*ruleJSON.JSONSet); err != nil {
+			return nil, at(err, "jsonSet")
+		}
+		if rule.Value, err = jsonPath.Decode(ruleJSON.Value); err != nil {
+			return nil, at(err, "value")
+		}
+	} else if ruleJSON.Value != nil {
+		return nil, at(errors.New("value can only be used with jsonSet"), "value")
+	}
+	if ruleJSON.JSONDelete != nil {
+		kinds++
+		if rule.JSONDelete, err = jsonPath.Parse(*ruleJSON.JSONDelete); err != nil {
+			return nil, at(err, "jsonDelete")
+		}
+	}
+	if ruleJSON.JSONMerge != nil {
+		kinds++
+		if rule.JSONMerge, err = jsonPath.Decode(ruleJSON.JSONMerge); err != nil {
+			return nil, at(err, "jsonMerge")
+		}
+		if _, ok := rule.JSONMerge.(map[string]interface{}); !ok {
+			return nil, at(errors.New("jsonMerge must be an object"), "jsonMerge")
+		}
+	}
+	if ruleJSON.JSONPatch != nil {
+		kinds++
+		rule.JSONPatch = []PatchOp{}
+		for i, opJSON := range ruleJSON.JSONPatch {
+			op, err := compilePatchOp(opJSON)
+			if err != nil {
+				return nil, at(err, "jsonPatch", i)
+			}
+			rule.JSONPatch = append(rule.JSONPatch, *op)
+		}
+	}
+	if kinds > 1 {
+		return nil, errors.New("Illegal field choice in rewrite rule, use one of jsonSet, jsonDelete, jsonMerge and jsonPatch")
+	}
+	return &rule, nil
+}
+
+func compilePatchOp(opJSON PatchOpJSON) (*PatchOp, error) {
+	op := PatchOp{Op: opJSON.Op}
+	var err error
+	if op.Path, err = jsonPath.ParsePointer(opJSON.Path); err != nil {
+		return nil, at(err, "path")
+	}
+	switch opJSON.Op {
+	case "add", "replace", "test":
+		if opJSON.Value == nil {
+			return nil, errors.New("jsonPatch " + opJSON.Op + " needs a value")
+		}
+		if op.Value, err = jsonPath.Decode(opJSON.Value); err != nil {
+			return nil, at(err, "value")
+		}
+	case "move", "copy":
+		if opJSON.From == nil {
+			return nil, errors.New("jsonPatch " + opJSON.Op + " needs from")
+		}
+		if op.From, err = jsonPath.ParsePointer(*opJSON.From); err != nil {
+			return nil, at(err, "from")
+		}
+	case "remove":
+	default:
+		return nil, at(errors.New("Unknown jsonPatch op: "+opJSON.Op), "op")
+	}
+	return &op, nil
+}
+
+func compileHeaderOp(opJSON HeaderOpJSON) (*HeaderOp, error) {
+	if opJSON.Name == "" {
+		return nil, at(errors.New("headerOps "+opJSON.Op+" needs a name"), "name")
+	}
+	op := HeaderOp{
+		Op:   opJSON.Op,
+		Name: http.CanonicalHeaderKey(opJSON.Name),
+	}
+	var err error
+	switch opJSON.Op {
+	case "set", "add":
+		if opJSON.Value == nil || opJSON.To != nil || opJSON.Find != nil || opJSON.Replace != nil {
+			return nil, errors.New("headerOps " + opJSON.Op + " needs a value and nothing else")
+		}
+		op.Value = *opJSON.Value
+	case "remove":
+		if opJSON.Value != nil || opJSON.To != nil || opJSON.Find != nil || opJSON.Replace != nil {
+			return nil, errors.New("headerOps remove only takes a name")
+		}
+	case "rename":
+		if opJSON.To == nil || *opJSON.To == "" || opJSON.Value != nil || opJSON.Find != nil || opJSON.Replace != nil {
+			return nil, errors.New("headerOps rename needs to and nothing else")
+		}
+		op.To = http.CanonicalHeaderKey(*opJSON.To)
+	case "replace":
+		if opJSON.Find == nil || opJSON.Replace == nil || opJSON.Value != nil || opJSON.To != nil {
+			return nil, errors.New("headerOps replace needs find and replace and nothing else")
+		}
+		if op.Find, err = regexp.Compile(*opJSON.Find); err != nil {
+			return nil, at(err, "find")
+		}
+		op.Replace = *opJSON.Replace
+	default:
+		return nil, at(errors.New("Unknown headerOps op: "+opJSON.Op), "op")
+	}
+	return &op, nil
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prxConfig
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigError is a problem at a place in a config. Entry, Section, Part and
+// Rule are only set if the problem is in them.
+type ConfigError struct {
+	Path    string `json:"path"`              // like rules[2].rewrite.request.header[0].find
+	Entry   *int   `json:"entry,omitempty"`   // index in rules
+	Section string `json:"section,omitempty"` // request or response
+	Part    string `json:"part,omitempty"`    // url, header, headerOps, body, events or status
+	Rule    *int   `json:"rule,omitempty"`    // index in the part
+	Field   string `json:"field,omitempty"`   // the rest of the path, like find
+	Message string `json:"message"`
+
+	steps []interface{} // keys and indexes from the top of the config
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+func formatSteps(steps []interface{}) string {
+	var path strings.Builder
+	for _, step := range steps {
+		if i, ok := step.(int); ok {
+			path.WriteString("[" + strconv.Itoa(i) + "]")
+			continue
+		}
+		if path.Len() > 0 {
+			path.WriteString(".")
+		}
+		path.WriteString(step.(string))
+	}
+	return path.String()
+}
+
+// fill sets the exported fields from steps.
+func (e *ConfigError) fill() {
+	e.Path = formatSteps(e.steps)
+	e.Entry, e.Section, e.Part, e.Rule = nil, "", "", nil
+	rest := e.steps
+	if len(rest) >= 2 && rest[0] == "rules" {
+		if i, ok := rest[1].(int); ok {
+			e.Entry = &i
+			rest = rest[2:]
+		}
+	}
+	if len(rest) >= 3 && rest[0] == "rewrite" {
+		e.Section, _ = rest[1].(string)
+		e.Part, _ = rest[2].(string)
+		rest = rest[3:]
+		if len(rest) > 0 {
+			if i, ok := rest[0].(int); ok {
+				e.Rule = &i
+				rest = rest[1:]
+			}
+		}
+	}
+	e.Field = formatSteps(rest)
+}
+
+// at puts err under the keys and indexes in steps.
+func at(err error, steps ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	e, ok := err.(*ConfigError)
+	if !ok {
+		e = &ConfigError{Message: err.Error()}
+	}
+	e.steps = append(append([]interface{}{}, steps...), e.steps...)
+	e.fill()
+	return e
+}
+
+// ParseConfig decodes a config, unlike json.Unmarshal it does not ignore keys
+// it does not know, so that typos are not silently ignored.
+func ParseConfig(data []byte) (Config, error) {
+	var config Config
+	err := parseStrict(data, &config)
+	return config, err
+}
+
+// ParseEntry decodes a single rule like ParseConfig.
+func ParseEntry(data []byte) (EntryJSON, error) {
+	var entry EntryJSON
+	err := parseStrict(data, &entry)
+	return entry, err
+}
+
+func parseStrict(data []byte, v interface{}) error {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if err := checkValue(doc, reflect.TypeOf(v).Elem()); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// jsonFields returns the fields of struct type t by their json name.
+func jsonFields(t reflect.Type) (map[string]reflect.StructField, []string) {
+	fields := make(map[string]reflect.StructField)
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field
+		names = append(names, name)
+	}
+	return fields, names
+}
+
+// similarKey returns the key of names that key is probably a typo of, or "".
+func similarKey(key string, names []string) string {
+	for _, name := range names {
+		if strings.EqualFold(key, name) || strings.EqualFold(key, name+"s") || strings.EqualFold(key+"s", name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// checkValue checks that value, decoded from JSON, has only keys and types
+// that fit t.
+func checkValue(value interface{}, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if value == nil || t == rawMessageType || t.Kind() == reflect.Interface {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.New("Must be an object")
+		}
+		fields, names := jsonFields(t)
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field, ok := fields[key]
+			if !ok {
+				message := "Unknown key, the keys here are " + strings.Join(names, ", ")
+				if similar := similarKey(key, names); similar != "" {
+					message = "Unknown key, did you mean " + similar + "?"
+				}
+				return at(errors.New(message), key)
+			}
+			if err := checkValue(object[key], field.Type); err != nil {
+				return at(err, key)
+			}
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.New("Must be an object")
+		}
+		for key, item := range object {
+			if err := checkValue(item, t.Elem()); err != nil {
+				return at(err, key)
+			}
+		}
+	case reflect.Slice:
+		array, ok := value.([]interface{})
+		if !ok {
+			return errors.New("Must be an array")
+		}
+		for i, item := range array {
+			if err := checkValue(item, t.Elem()); err != nil {
+				return at(err, i)
+			}
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return errors.New("Must be a string")
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return errors.New("Must be true or false")
+		}
+	case reflect.Int, reflect.Int64:
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			return errors.New("Must be a whole number")
+		}
+	case reflect.Uint64:
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) || n < 0 {
+			return errors.New("Must be a whole number, 0 or more")
+		}
+	case reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			return errors.New("Must be a number")
+		}
+	}
+	return nil
+}
+
+// Values some string keys can have, by type and json name.
+var schemaEnums = map[string][]string{
+	"HeaderOpJSON.op": {"set", "add", "remove", "rename", "replace"},
+	"PatchOpJSON.op":  {"add", "remove", "replace", "move", "copy", "test"},
+
+	"WebSocketMessageJSON.to": {"client", "server"},
+}
+
+// Schema returns a JSON schema (draft 7) of Config.
+func Schema() map[string]interface{} {
+	definitions := make(map[string]interface{})
+	config := schemaOf(reflect.TypeOf(Config{}), definitions)
+	return map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "restfulHttpsProxy rules",
+		"allOf":       []interface{}{config},
+		"definitions": definitions,
+	}
+}
+
+func schemaOf(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == rawMessageType || t.Kind() == reflect.Interface {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+		if _, ok := definitions[t.Name()]; ok {
+			return ref
+		}
+		properties := make(map[string]interface{})
+		definition := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		// Added before the fields, for types that contain themselves.
+		definitions[t.Name()] = definition
+		fields, names := jsonFields(t)
+		for _, name := range names {
+			properties[name] = schemaOf(fields[name].Type, definitions)
+			if enum, ok := schemaEnums[t.Name()+"."+name]; ok {
+				properties[name].(map[string]interface{})["enum"] = enum
+			}
+		}
+		return ref
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaOf(t.Elem(), definitions),
+		}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaOf(t.Elem(), definitions),
+		}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
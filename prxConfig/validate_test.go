@@ -0,0 +1,75 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prxConfig
+
+import (
+	"testing"
+)
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		path   string
+		entry  int
+		part   string
+	}{
+		{`{"rules": [{}, {"rewrite": {"response": {"headers": []}}}]}`, "rules[1].rewrite.response.headers", 1, "headers"},
+		{`{"rules": [{"rewrite": {"request": {"header": [{"find": "a", "replace": "b"}, {"find": "(", "replace": ""}]}}}]}`, "rules[0].rewrite.request.header[1].find", 0, "header"},
+		{`{"rules": [{"url": "a"}, {"url": "b"}, {"match": {"or": [{"method": "["}]}}]}`, "rules[2].match.or[0].method", 2, ""},
+		{`{"rules": [{"rewrite": {"response": {"status": [{"jsonDelete": "$.a"}]}}}]}`, "rules[0].rewrite.response.status[0]", 0, "status"},
+		{`{"rules": [{"downloadSpeed": "fast"}]}`, "rules[0].downloadSpeed", 0, ""},
+		{`{"rules": [{"webSocket": {"fromClient": [{"find": "a"}, {"replace": "b"}]}}]}`, "rules[0].webSocket.fromClient[1].replace", 0, ""},
+		{`{"rules": [{"webSocket": {"open": [{"to": "both", "text": "a"}]}}]}`, "rules[0].webSocket.open[0].to", 0, ""},
+		{`{"rules": [{"rewrite": {"request": {"events": [{"find": "a", "replace": "b"}]}}}]}`, "rules[0].rewrite.request.events", 0, "events"},
+		{`{"rules": [{"respond": {"file": "/etc/passwd"}}]}`, "rules[0].respond.file", 0, ""},
+		{`{"rules": [{"respond": {"file": "mocks/../../key.pem"}}]}`, "rules[0].respond.file", 0, ""},
+	}
+	for _, test := range tests {
+		config, err := ParseConfig([]byte(test.config))
+		if err == nil {
+			_, err = Compile(config)
+		}
+		configErr, ok := err.(*ConfigError)
+		if !ok {
+			t.Errorf("%s: got %v, want a ConfigError", test.config, err)
+			continue
+		}
+		if configErr.Path != test.path || configErr.Entry == nil || *configErr.Entry != test.entry || configErr.Part != test.part {
+			t.Errorf("%s: got %+v, want %s", test.config, configErr, test.path)
+		}
+	}
+
+	if _, err := ParseConfig([]byte(`{"rule": []}`)); err == nil || err.Error() != "rule: Unknown key, did you mean rules?" {
+		t.Errorf("got %v", err)
+	}
+	config, err := ParseConfig([]byte(`{"rules": [{"match": {"header": {"Accept": "json"}}, "rewrite": {"request": {"headerOps": [{"op": "set", "name": "a", "value": "b"}]}}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compile(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is read when the response is served, it may not exist yet.
+	config, err = ParseConfig([]byte(`{"rules": [{"respond": {"file": "does/not/exist.json"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compile(config); err != nil {
+		t.Error(err)
+	}
+}
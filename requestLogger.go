@@ -17,77 +17,37 @@ limitations under the License.
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	//"net/http/httputil"
 	"bytes"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"restfulHttpsProxy/proxy"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 )
 
-func copyResponse(resp *http.Response) *http.Response {
-	var respCopy http.Response
-	respCopy = *resp
-	resp.Body, respCopy.Body = CloneReadCloser(resp.Body)
-	return &respCopy
-}
+// Bodies bigger than this are truncated in the log.
+const maxLoggedBodySize = 1 << 20
 
-func copyRequest(req *http.Request) *http.Request {
-	var reqCopy http.Request
-	reqCopy = *req
-	req.Body, reqCopy.Body = CloneReadCloser(req.Body)
-	return &reqCopy
-}
+// Only the first messages of a WebSocket are logged, and each one is
+// truncated to maxLoggedWebSocketMessageSize.
+const maxLoggedWebSocketMessages = 1000
+const maxLoggedWebSocketMessageSize = 64 << 10
 
-type CustomReadCloser struct {
-	Reader io.Reader
-	Closer io.Closer
-}
+var logDir = "logs"
 
-func CloneReadCloser(rc io.ReadCloser) (io.ReadCloser, io.ReadCloser) {
-	pr, pw := io.Pipe()
-	tee := io.TeeReader(rc, pw)
-
-	var teeRc CustomReadCloser
-	var dupRc CustomReadCloser
-	teeRc.Reader = tee
-	teeRc.Closer = rc
-	dupRc.Reader = pr
-	dupRc.Closer = nil
-	return &teeRc, &dupRc
-}
-
-// func CloneReadCloser(rc io.ReadCloser) (io.ReadCloser, io.ReadCloser) {
-// 	var buf bytes.Buffer
-// 	tee := io.TeeReader(rc, &buf)
-//
-// 	var teeRc CustomReadCloser
-// 	var bufRc CustomReadCloser
-// 	teeRc.Reader = tee
-// 	teeRc.Closer = rc
-// 	bufRc.Reader = &buf
-// 	bufRc.Closer = nil
-// 	return &teeRc, &bufRc
-// }
-
-// func CloneReadCloser(rc io.ReadCloser) (io.ReadCloser, io.ReadCloser) {
-// 	return rc, nil
-// }
-
-func (r *CustomReadCloser) Read(p []byte) (n int, err error) {
-	return r.Reader.Read(p)
-}
-
-func (r *CustomReadCloser) Close() (err error) {
-	if r.Closer == nil {
-		return nil
-	}
-	err = r.Closer.Close()
-	return
+// logPath is the file with the round trips of session, which can be a header
+// value that the client chose, so it must not be able to leave the directory.
+func logPath(session string) string {
+	return filepath.Join(logDir, url.PathEscape(session)+".log")
 }
 
 type loggingProperties struct {
@@ -96,24 +56,85 @@ type loggingProperties struct {
 }
 
 type requestLog struct {
-	URL     string `json:"url"`
-	Headers string `json:"headers"`
-	Body    string `json:"body"`
+	Method       string `json:"method"`
+	URL          string `json:"url"`
+	HTTPVersion  string `json:"httpVersion"`
+	Headers      string `json:"headers"`
+	Body         string `json:"body"`
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+	BodySize     int64  `json:"bodySize"`
+	Timestamp    int64  `json:"timestamp"`
 }
 
 type responseLog struct {
-	Status  string `json:"status"`
-	Headers string `json:"headers"`
-	Body    string `json:"body"`
+	Status       string `json:"status"`
+	HTTPVersion  string `json:"httpVersion"`
+	Headers      string `json:"headers"`
+	Body         string `json:"body"`
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+	BodySize     int64  `json:"bodySize"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+// webSocketMessageLog is a message of a WebSocket as it was sent on, Original
+// is the message that was received if a rule changed it. Binary messages are
+// in base64.
+type webSocketMessageLog struct {
+	FromClient   bool    `json:"fromClient"`
+	Binary       bool    `json:"binary,omitempty"`
+	Data         string  `json:"data"`
+	DataEncoding string  `json:"dataEncoding,omitempty"`
+	Size         int     `json:"size"`
+	Original     *string `json:"original,omitempty"`
+	Dropped      bool    `json:"dropped,omitempty"`
+	Injected     bool    `json:"injected,omitempty"` // sent by a rule, not by the client or the server
+	Timestamp    int64   `json:"timestamp"`
+}
+
+// Times are in milliseconds, -1 if the phase did not happen.
+type timingsLog struct {
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
 }
 
 type roundTripLog struct {
-	Req  requestLog  `json:"request"`
-	Resp responseLog `json:"response,omitempty"`
+	Req          requestLog  `json:"request"`
+	RewrittenReq requestLog  `json:"rewrittenRequest"`
+	OriginalResp responseLog `json:"originalResponse"`
+	Resp         responseLog `json:"response,omitempty"`
+	Timings      timingsLog  `json:"timings"`
+	Rules        []string    `json:"rules,omitempty"`    // ids of the rules that matched
+	RuleHits     []ruleLog   `json:"ruleHits,omitempty"` // what every rule did, in debug mode
+	Error        string      `json:"error,omitempty"`    // why the client got no response
+
+	// If the request opened a WebSocket, the entry is logged when it closes.
+	WebSocketMessages     []webSocketMessageLog `json:"webSocketMessages,omitempty"`
+	WebSocketMessageCount int                   `json:"webSocketMessageCount,omitempty"` // logged or not
 }
 
+var logPropsMu sync.Mutex
 var logProps = make(map[string]*loggingProperties)
 
+func getLogProps(ip string) *loggingProperties {
+	logPropsMu.Lock()
+	defer logPropsMu.Unlock()
+	if logProps[ip] == nil {
+		logProps[ip] = &loggingProperties{}
+	}
+	return logProps[ip]
+}
+
+func isLogging(ip string) bool {
+	props := getLogProps(ip)
+	props.Mutex.Lock()
+	defer props.Mutex.Unlock()
+	return props.recording
+}
+
 func formatJSON(b []byte) ([]byte, error) {
 	var out bytes.Buffer
 	err := json.Indent(&out, b, "", "\t")
@@ -132,28 +153,28 @@ func headerToString(h http.Header) string {
 	return s.String()
 }
 
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
 func startLogging(ip string) {
-	if logProps[ip] == nil {
-		logProps[ip] = &loggingProperties{}
-	}
-	logProps[ip].Mutex.Lock()
-	logProps[ip].recording = true
-	logProps[ip].Mutex.Unlock()
+	props := getLogProps(ip)
+	props.Mutex.Lock()
+	props.recording = true
+	props.Mutex.Unlock()
 }
 
 func stopLogging(ip string) {
-	if logProps[ip] == nil {
-		logProps[ip] = &loggingProperties{}
-	}
-	logProps[ip].Mutex.Lock()
-	logProps[ip].recording = false
-	logProps[ip].Mutex.Unlock()
+	props := getLogProps(ip)
+	props.Mutex.Lock()
+	props.recording = false
+	props.Mutex.Unlock()
 }
 
 //json data in body
 type logResponseBody struct {
 	readCloser io.ReadCloser
-	ip         string
+	props      *loggingProperties
 }
 
 func (lrc *logResponseBody) Read(p []byte) (int, error) {
@@ -162,46 +183,51 @@ func (lrc *logResponseBody) Read(p []byte) (int, error) {
 
 func (lrc *logResponseBody) Close() error {
 	err := lrc.readCloser.Close()
-	logProps[lrc.ip].Mutex.Unlock()
+	lrc.props.Mutex.Unlock()
 	return err
 }
 
+// The returned body holds the log lock for ip until it is closed.
 func getLogs(ip string) io.ReadCloser {
-	if logProps[ip] == nil {
-		logProps[ip] = &loggingProperties{}
-	}
-	logProps[ip].Mutex.Lock()
+	props := getLogProps(ip)
+	props.Mutex.Lock()
 	var readCloser io.ReadCloser
-	readCloser = getRequestLogFile("logs/" + ip + ".log")
+	file := getRequestLogFile(logPath(ip))
+	if file != nil {
+		if info, err := file.Stat(); err == nil && info.Size() > 0 {
+			readCloser = file
+		} else {
+			file.Close()
+		}
+	}
 	if readCloser == nil {
-		readCloser = ioutil.NopCloser(strings.NewReader(""))
+		readCloser = ioutil.NopCloser(strings.NewReader("[]"))
 	}
 	var lrc logResponseBody
-	lrc.ip = ip
+	lrc.props = props
 	lrc.readCloser = readCloser
 	return &lrc
 }
 
 func clearLogs(ip string) {
-	if logProps[ip] == nil {
-		logProps[ip] = &loggingProperties{}
-	}
-	logProps[ip].Mutex.Lock()
-	os.Remove("logs/" + ip + ".log")
-	logProps[ip].Mutex.Unlock()
+	props := getLogProps(ip)
+	props.Mutex.Lock()
+	os.Remove(logPath(ip))
+	props.Mutex.Unlock()
 }
 
-func logRequest(ip string, req *http.Request, resp *http.Response) {
+func logRequest(ip string, log roundTripLog) {
 	go func() {
-		if logProps[ip] == nil {
-			logProps[ip] = &loggingProperties{}
+		props := getLogProps(ip)
+		props.Mutex.Lock()
+		defer props.Mutex.Unlock()
+		if props.recording == false {
+			return
 		}
-		logProps[ip].Mutex.Lock()
-		defer logProps[ip].Mutex.Unlock()
-		if logProps[ip].recording == false {
+		file := getRequestLogFile(logPath(ip))
+		if file == nil {
 			return
 		}
-		file := getRequestLogFile("logs/" + ip + ".log")
 		defer file.Close()
 		token := make([]byte, 1)
 		if n, err := file.Read(token); err != nil || n != 1 || token[0] != '[' {
@@ -212,24 +238,14 @@ func logRequest(ip string, req *http.Request, resp *http.Response) {
 		if n, err := file.Read(token); err == nil && n == 1 && token[0] == '}' {
 			file.Write([]byte(","))
 		}
-		var log roundTripLog
-		log.Req.URL = req.URL.String()
-		log.Req.Headers = headerToString(req.Header)
-		//reqBody, _ := ioutil.ReadAll(req.Body)
-		log.Req.Body = "not supported yet" //string(reqBody)
-		log.Resp.Status = resp.Status
-		log.Resp.Headers = headerToString(resp.Header)
-		//respBody, _ := ioutil.ReadAll(resp.Body)
-		log.Resp.Body = "not supported yet" //string(respBody)
-		bytes, err := json.Marshal(log)
-		if err != nil {
-			return
-		}
-		bytes, err = formatJSON(bytes)
-		if err != nil {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "\t")
+		if err := encoder.Encode(log); err != nil {
 			return
 		}
-		file.Write(bytes)
+		file.Write(bytes.TrimRight(buf.Bytes(), "\n"))
 
 		file.Write([]byte("]"))
 	}()
@@ -240,6 +256,286 @@ func getRequestLogFile(path string) *os.File {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		os.MkdirAll(dir, 0755)
 	}
-	f, _ := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil
+	}
 	return f
 }
+
+/*
+--------------------------------------------------------------------------------
+*/
+
+// limitedBuffer keeps the first limit bytes written to it and silently drops
+// the rest, so it never makes a tee fail.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	total int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.total += int64(n)
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		if room < 0 {
+			room = 0
+		}
+		p = p[:room]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// content returns the buffered data as text, or base64 if it isn't utf8.
+func (b *limitedBuffer) content() (text string, encoding string) {
+	if utf8.Valid(b.buf.Bytes()) {
+		return b.buf.String(), ""
+	}
+	return base64.StdEncoding.EncodeToString(b.buf.Bytes()), "base64"
+}
+
+type closeNotifier struct {
+	io.ReadCloser
+	once    sync.Once
+	onClose func()
+}
+
+func (cn *closeNotifier) Close() error {
+	err := cn.ReadCloser.Close()
+	cn.once.Do(cn.onClose)
+	return err
+}
+
+// roundTripRecorder collects one round trip while it passes through the proxy.
+// A nil recorder is valid and records nothing.
+type roundTripRecorder struct {
+	ip  string
+	log roundTripLog
+
+	reqBody          limitedBuffer
+	rewrittenReqBody limitedBuffer
+	originalRespBody limitedBuffer
+	respBody         limitedBuffer
+
+	respReceived time.Time
+
+	ruleLogs []ruleLog
+
+	answered bool // a response will finish the entry
+
+	webSocketMu sync.Mutex // guards the messages, both directions record them
+}
+
+func snapshotRequest(req *http.Request) requestLog {
+	return requestLog{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Headers:     headerToString(req.Header),
+		Timestamp:   timestamp(time.Now()),
+	}
+}
+
+func snapshotResponse(resp *http.Response) responseLog {
+	return responseLog{
+		Status:      resp.Status,
+		HTTPVersion: resp.Proto,
+		Headers:     headerToString(resp.Header),
+		Timestamp:   timestamp(time.Now()),
+	}
+}
+
+func (l *requestLog) setBody(b *limitedBuffer) {
+	l.Body, l.BodyEncoding = b.content()
+	l.BodySize = b.total
+}
+
+func (l *responseLog) setBody(b *limitedBuffer) {
+	l.Body, l.BodyEncoding = b.content()
+	l.BodySize = b.total
+}
+
+func durationToMs(d time.Duration) float64 {
+	if d < 0 {
+		return -1
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+func teeBody(body io.ReadCloser, buf *limitedBuffer) io.ReadCloser {
+	if body == nil {
+		return nil
+	}
+	buf.limit = maxLoggedBodySize
+	return proxy.TeeReadCloser(body, buf)
+}
+
+// recordRoundTrip starts recording req if logging is enabled for ip or its
+// traffic is streamed. It must be called before any rewrite rule touches req.
+func recordRoundTrip(ip string, req *http.Request) *roundTripRecorder {
+	if !isLogging(ip) && !isStreamed(ip) {
+		return nil
+	}
+	rec := &roundTripRecorder{ip: ip}
+	rec.log.Req = snapshotRequest(req)
+	rec.log.Timings = timingsLog{DNS: -1, Connect: -1, SSL: -1}
+	req.Body = teeBody(req.Body, &rec.reqBody)
+	return rec
+}
+
+// recordRule records that the rule with id matched.
+func (rec *roundTripRecorder) recordRule(id string) {
+	if rec == nil {
+		return
+	}
+	rec.log.Rules = append(rec.log.Rules, id)
+}
+
+// recordRuleLogs records what every rule did, the body counts are read when
+// the round trip is done.
+func (rec *roundTripRecorder) recordRuleLogs(logs []ruleLog) {
+	if rec == nil {
+		return
+	}
+	rec.ruleLogs = logs
+}
+
+// recordRewrittenRequest records req as it is about to be sent upstream.
+func (rec *roundTripRecorder) recordRewrittenRequest(req *http.Request) {
+	if rec == nil {
+		return
+	}
+	rec.log.RewrittenReq = snapshotRequest(req)
+	req.Body = teeBody(req.Body, &rec.rewrittenReqBody)
+}
+
+// recordOriginalResponse records resp as it came from the server, before any
+// rewrite rule touches it.
+func (rec *roundTripRecorder) recordOriginalResponse(resp *http.Response, timings proxy.RoundTripTimings) {
+	if rec == nil {
+		return
+	}
+	rec.respReceived = time.Now()
+	rec.log.OriginalResp = snapshotResponse(resp)
+	rec.log.Timings.DNS = durationToMs(timings.DNS)
+	rec.log.Timings.Connect = durationToMs(timings.Connect)
+	rec.log.Timings.SSL = durationToMs(timings.TLS)
+	rec.log.Timings.Send = durationToMs(timings.Send)
+	rec.log.Timings.Wait = durationToMs(timings.Wait)
+	resp.Body = teeBody(resp.Body, &rec.originalRespBody)
+}
+
+// recordResponse records resp as it is sent to the client, the entry is
+// written to the log once the response body is closed.
+func (rec *roundTripRecorder) recordResponse(resp *http.Response) {
+	if rec == nil {
+		return
+	}
+	if rec.respReceived.IsZero() {
+		rec.respReceived = time.Now()
+	}
+	rec.answered = true
+	rec.log.Resp = snapshotResponse(resp)
+	if resp.Body == nil || resp.ContentLength == 0 {
+		rec.finish()
+		return
+	}
+	resp.Body = &closeNotifier{
+		ReadCloser: teeBody(resp.Body, &rec.respBody),
+		onClose:    rec.finish,
+	}
+}
+
+// recordUpgrade records the response that opened a WebSocket, the entry is
+// written to the log once it is closed, see finishWebSocket.
+func (rec *roundTripRecorder) recordUpgrade(resp *http.Response) {
+	if rec == nil {
+		return
+	}
+	if rec.respReceived.IsZero() {
+		rec.respReceived = time.Now()
+	}
+	rec.answered = true
+	rec.log.Resp = snapshotResponse(resp)
+}
+
+// finishUnanswered writes the entry to the log with err if the client got
+// no response, so that failed round trips are logged too.
+func (rec *roundTripRecorder) finishUnanswered(err error) {
+	if rec == nil || rec.answered {
+		return
+	}
+	if rec.respReceived.IsZero() {
+		rec.respReceived = time.Now()
+	}
+	rec.log.Error = "no response"
+	if err != nil {
+		rec.log.Error = err.Error()
+	}
+	rec.finish()
+}
+
+// webSocketData returns data as it is logged, cut to limit bytes.
+func webSocketData(data []byte, binary bool, limit int) (text string, encoding string) {
+	if len(data) > limit {
+		data = data[:limit]
+	}
+	if binary || !utf8.Valid(data) {
+		return base64.StdEncoding.EncodeToString(data), "base64"
+	}
+	return string(data), ""
+}
+
+// recordWebSocketMessage records message as it is sent on, original is the
+// data that was received if it is not the same.
+func (rec *roundTripRecorder) recordWebSocketMessage(message proxy.WebSocketMessage, original []byte, dropped bool, injected bool) {
+	if rec == nil {
+		return
+	}
+	l := webSocketMessageLog{
+		FromClient: message.FromClient,
+		Binary:     message.Binary,
+		Size:       len(message.Data),
+		Dropped:    dropped,
+		Injected:   injected,
+		Timestamp:  timestamp(time.Now()),
+	}
+	l.Data, l.DataEncoding = webSocketData(message.Data, message.Binary, maxLoggedWebSocketMessageSize)
+	if original != nil {
+		o, _ := webSocketData(original, message.Binary || l.DataEncoding != "", maxLoggedWebSocketMessageSize)
+		l.Original = &o
+	}
+	publishWebSocketMessage(rec.ip, rec.log.Req, l)
+
+	rec.webSocketMu.Lock()
+	defer rec.webSocketMu.Unlock()
+	rec.log.WebSocketMessageCount++
+	if len(rec.log.WebSocketMessages) < maxLoggedWebSocketMessages {
+		rec.log.WebSocketMessages = append(rec.log.WebSocketMessages, l)
+	}
+}
+
+// finishWebSocket writes the entry of a WebSocket to the log.
+func (rec *roundTripRecorder) finishWebSocket() {
+	if rec == nil {
+		return
+	}
+	rec.webSocketMu.Lock()
+	defer rec.webSocketMu.Unlock()
+	rec.finish()
+}
+
+func (rec *roundTripRecorder) finish() {
+	rec.log.Timings.Receive = durationToMs(time.Since(rec.respReceived))
+	rec.log.Req.setBody(&rec.reqBody)
+	rec.log.RewrittenReq.setBody(&rec.rewrittenReqBody)
+	rec.log.OriginalResp.setBody(&rec.originalRespBody)
+	rec.log.Resp.setBody(&rec.respBody)
+	if rec.ruleLogs != nil {
+		rec.log.RuleHits = snapshotRuleLogs(rec.ruleLogs)
+	}
+	publishTraffic(rec.ip, rec.log)
+	logRequest(rec.ip, rec.log)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"restfulHttpsProxy/proxy"
+	"restfulHttpsProxy/prxConfig"
+	"restfulHttpsProxy/rewriteLogic"
+)
+
+// rewriteRequest applies the request rewrites of entry to req and counts
+// them in hits. Throttles and faults are left to the caller.
+func rewriteRequest(entry *prxConfig.Entry, req *http.Request, hits *ruleLog) error {
+	replaced, err := rewriteLogic.AlterURL(req.URL, entry.Rewrite.Request.URL)
+	if err != nil {
+		return err
+	}
+	hits.URL += int64(replaced)
+
+	replaced, err = rewriteLogic.AlterHeader(&req.Header, entry.Rewrite.Request.Header)
+	if err != nil {
+		return err
+	}
+	replaced += rewriteLogic.AlterHeaderOps(req.Header, entry.Rewrite.Request.HeaderOps)
+	hits.RequestHeader += int64(replaced)
+
+	// empty body might be replaced, fix this later
+	if len(entry.Rewrite.Request.Body) > 0 {
+		req.Body = rewriteLogic.AlterBody(
+			req.Body,
+			regexBufferSize,
+			entry.Rewrite.Request.Body,
+			&hits.RequestBody,
+		)
+		req.ContentLength = -1
+		if rewriteLogic.HasJSONRule(entry.Rewrite.Request.Body) {
+			req.Body, req.ContentLength = bufferBody(req.Body)
+		}
+	}
+	return nil
+}
+
+// streamsResponse tells if resp must reach the client as it comes, because it has
+// server-sent events or a rule that matched says so.
+func streamsResponse(rules prxConfig.RewriteRules, logs []ruleLog, resp *http.Response) bool {
+	if proxy.IsEventStream(resp.Header) {
+		return true
+	}
+	for i := range rules {
+		if logs[i].Matched && rules[i].Streaming {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteResponse applies the response rewrites of entry to resp and counts
+// them in hits. Streamed responses are rewritten as they come, see
+// streamsResponse. Throttles and delays are left to the caller.
+func rewriteResponse(entry *prxConfig.Entry, resp *http.Response, hits *ruleLog, streamed bool) {
+	eventStream := proxy.IsEventStream(resp.Header)
+	replaced, _ := rewriteLogic.AlterHeader(&resp.Header, entry.Rewrite.Response.Header)
+	replaced += rewriteLogic.AlterHeaderOps(resp.Header, entry.Rewrite.Response.HeaderOps)
+	hits.ResponseHeader += int64(replaced)
+	hits.Status += int64(rewriteLogic.AlterStatus(resp, entry.Rewrite.Response.Status))
+
+	if len(entry.Rewrite.Response.Events) > 0 && eventStream {
+		resp.Body = rewriteLogic.AlterEvents(resp.Body, entry.Rewrite.Response.Events, &hits.ResponseEvents)
+		resp.ContentLength = -1
+	}
+	if len(entry.Rewrite.Response.Body) > 0 && streamed {
+		resp.Body = rewriteLogic.AlterStream(resp.Body, entry.Rewrite.Response.Body, &hits.ResponseBody)
+		resp.ContentLength = -1
+	} else if len(entry.Rewrite.Response.Body) > 0 {
+		// empty body might be replaced, fix this later
+		resp.Body = rewriteLogic.AlterBody(
+			resp.Body,
+			regexBufferSize,
+			entry.Rewrite.Response.Body,
+			&hits.ResponseBody,
+		)
+		resp.ContentLength = -1
+		if rewriteLogic.HasJSONRule(entry.Rewrite.Response.Body) {
+			resp.Body, resp.ContentLength = bufferBody(resp.Body)
+		}
+	}
+}
@@ -75,6 +75,14 @@ type fixedChunkRegexReader struct {
 	midIndex   int
 
 	bufferSize int
+
+	counter *int64 // replacements made, may be nil
+}
+
+func (r *fixedChunkRegexReader) replaceAll(buffer []byte) []byte {
+	buffer, n := replaceAll(r.find, buffer, r.replace)
+	count(r.counter, n)
+	return buffer
 }
 
 func FixedChunkRegexReader(reader io.Reader, bufferSize int, find *regexp.Regexp, replace []byte) *fixedChunkRegexReader {
@@ -101,12 +109,12 @@ func (r *fixedChunkRegexReader) Read() ([]byte, error) {
 		)
 		if err != nil {
 			buffer := r.buffer[:n]
-			buffer = r.find.ReplaceAll(buffer, r.replace)
+			buffer = r.replaceAll(buffer)
 			return buffer, err
 		}
 
 		buffer := r.buffer
-		buffer = r.find.ReplaceAll(buffer, r.replace)
+		buffer = r.replaceAll(buffer)
 		r.rightIndex = len(buffer)
 		r.midIndex = r.rightIndex / 2
 		r.buffer = make([]byte, len(buffer))
@@ -125,11 +133,11 @@ func (r *fixedChunkRegexReader) Read() ([]byte, error) {
 	)
 	if err != nil {
 		buffer = r.buffer[:r.midIndex+n]
-		buffer = r.find.ReplaceAll(buffer, r.replace)
+		buffer = r.replaceAll(buffer)
 		return buffer, err
 	}
 
-	buffer = r.find.ReplaceAll(r.buffer, r.replace)
+	buffer = r.replaceAll(r.buffer)
 	r.rightIndex = len(buffer)
 	r.midIndex = (r.rightIndex) / 2
 
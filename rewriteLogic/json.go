@@ -0,0 +1,170 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rewriteLogic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"restfulHttpsProxy/jsonPath"
+	"restfulHttpsProxy/prxConfig"
+)
+
+// jsonRuleReader reads the whole input on the first Read and applies rule to
+// it. If the input is not JSON or the rule fails, the input is passed on as is.
+type jsonRuleReader struct {
+	input   io.Reader
+	rule    prxConfig.Rule
+	output  io.Reader
+	counter *int64
+}
+
+func (r *jsonRuleReader) Read(p []byte) (int, error) {
+	if r.output == nil {
+		data, err := ioutil.ReadAll(r.input)
+		if err != nil {
+			return 0, err
+		}
+		if newData, err := applyJSONRule(data, r.rule); err != nil {
+			log.Print(err)
+		} else {
+			data = newData
+			count(r.counter, 1)
+		}
+		r.output = bytes.NewReader(data)
+	}
+	return r.output.Read(p)
+}
+
+// HasJSONRule tells if rules need the whole body in memory.
+func HasJSONRule(rules []prxConfig.Rule) bool {
+	for i := range rules {
+		if rules[i].IsJSON() {
+			return true
+		}
+	}
+	return false
+}
+
+func applyJSONRule(data []byte, rule prxConfig.Rule) ([]byte, error) {
+	doc, err := jsonPath.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if rule.JSONSet != nil {
+		doc, err = rule.JSONSet.Set(doc, deepCopy(rule.Value))
+	} else if rule.JSONDelete != nil {
+		doc, err = rule.JSONDelete.Delete(doc)
+	} else if rule.JSONMerge != nil {
+		doc = MergePatch(doc, rule.JSONMerge)
+	} else if rule.JSONPatch != nil {
+		doc, err = applyPatch(doc, rule.JSONPatch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7396) to target.
+func MergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = MergePatch(targetObj[key], value)
+		}
+	}
+	return targetObj
+}
+
+// applyPatch applies a JSON Patch (RFC 6902), doc must not be used if it fails.
+func applyPatch(doc interface{}, ops []prxConfig.PatchOp) (interface{}, error) {
+	var err error
+	for _, op := range ops {
+		switch op.Op {
+		case "add":
+			doc, err = op.Path.Add(doc, deepCopy(op.Value))
+		case "remove":
+			doc, err = op.Path.Delete(doc)
+		case "replace":
+			if len(op.Path.Get(doc)) == 0 {
+				return nil, errors.New("Nothing to replace at " + op.Path.String())
+			}
+			doc, err = op.Path.Set(doc, deepCopy(op.Value))
+		case "move", "copy":
+			values := op.From.Get(doc)
+			if len(values) == 0 {
+				return nil, errors.New("Nothing to " + op.Op + " at " + op.From.String())
+			}
+			value := deepCopy(values[0])
+			if op.Op == "move" {
+				if doc, err = op.From.Delete(doc); err != nil {
+					return nil, err
+				}
+			}
+			doc, err = op.Path.Add(doc, value)
+		case "test":
+			values := op.Path.Get(doc)
+			if len(values) == 0 || !reflect.DeepEqual(values[0], op.Value) {
+				return nil, errors.New("jsonPatch test failed at " + op.Path.String())
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// deepCopy copies a decoded JSON value, so that a rule's value is never
+// shared between documents.
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			c[key] = deepCopy(child)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, child := range v {
+			c[i] = deepCopy(child)
+		}
+		return c
+	}
+	return value
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rewriteLogic
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"restfulHttpsProxy/prxConfig"
+	"sort"
+	"strconv"
+)
+
+type requestMatcher struct {
+	req  *http.Request
+	body []byte
+
+	doc       interface{}
+	docParsed bool
+	docErr    error
+}
+
+// MatchEntry tells if entry applies to req. body is the request body, only
+// needed if entry.Match looks at it, see prxConfig.RewriteRules.NeedsRequestBody.
+func MatchEntry(entry *prxConfig.Entry, req *http.Request, body []byte) bool {
+	return Mismatch(entry, req, body) == ""
+}
+
+// Mismatch tells which part of entry does not fit req, like "url",
+// "match.method" or "match.or", or "" if entry applies to req.
+func Mismatch(entry *prxConfig.Entry, req *http.Request, body []byte) string {
+	if !entry.URL.MatchString(req.URL.String()) {
+		return "url"
+	}
+	if entry.Match == nil {
+		return ""
+	}
+	m := requestMatcher{req: req, body: body}
+	if mismatch := m.mismatch(entry.Match); mismatch != "" {
+		return "match." + mismatch
+	}
+	return ""
+}
+
+func (m *requestMatcher) matches(match *prxConfig.Match) bool {
+	return m.mismatch(match) == ""
+}
+
+// mismatch returns the first condition of match that req fails, or "".
+func (m *requestMatcher) mismatch(match *prxConfig.Match) string {
+	if match.Method != nil && !match.Method.MatchString(m.req.Method) {
+		return "method"
+	}
+	if match.URL != nil && !match.URL.MatchString(m.req.URL.String()) {
+		return "url"
+	}
+	for _, key := range sortedKeys(match.Header) {
+		if !anyMatches(match.Header[key], m.req.Header[http.CanonicalHeaderKey(key)]) {
+			return "header." + key
+		}
+	}
+	if len(match.Query) > 0 {
+		query := m.req.URL.Query()
+		for _, key := range sortedKeys(match.Query) {
+			if !anyMatches(match.Query[key], query[key]) {
+				return "query." + key
+			}
+		}
+	}
+	if match.ClientPort != nil {
+		if !match.ClientPort.MatchString(ProxyPort(m.req)) {
+			return "clientPort"
+		}
+	}
+	if match.Body != nil && !match.Body.Match(m.body) {
+		return "body"
+	}
+	for _, pathMatch := range match.JSONPath {
+		doc, err := m.jsonBody()
+		if err != nil {
+			return "jsonPath"
+		}
+		var values []string
+		for _, value := range pathMatch.Path.Get(doc) {
+			values = append(values, jsonValueString(value))
+		}
+		if !anyMatches(pathMatch.Value, values) {
+			return "jsonPath." + pathMatch.Path.String()
+		}
+	}
+	for i := range match.And {
+		if mismatch := m.mismatch(&match.And[i]); mismatch != "" {
+			return "and." + strconv.Itoa(i) + "." + mismatch
+		}
+	}
+	if len(match.Or) > 0 {
+		anyOr := false
+		for i := range match.Or {
+			if m.matches(&match.Or[i]) {
+				anyOr = true
+				break
+			}
+		}
+		if !anyOr {
+			return "or"
+		}
+	}
+	if match.Not != nil && m.matches(match.Not) {
+		return "not"
+	}
+	return ""
+}
+
+// sortedKeys returns the keys of regexes sorted, so that the same request
+// always fails on the same one.
+func sortedKeys(regexes map[string]*regexp.Regexp) []string {
+	keys := make([]string, 0, len(regexes))
+	for key := range regexes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ProxyPort returns the port of the proxy the client of req connected to, ""
+// if req did not come through a listener.
+func ProxyPort(req *http.Request) string {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
+
+func (m *requestMatcher) jsonBody() (interface{}, error) {
+	if !m.docParsed {
+		m.docParsed = true
+		m.docErr = json.Unmarshal(m.body, &m.doc)
+	}
+	return m.doc, m.docErr
+}
+
+// Strings are matched without their quotes, everything else as JSON.
+func jsonValueString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+func anyMatches(regex *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if regex.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
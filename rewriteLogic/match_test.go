@@ -0,0 +1,55 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rewriteLogic
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"restfulHttpsProxy/prxConfig"
+	"testing"
+)
+
+func TestMismatch(t *testing.T) {
+	anything := regexp.MustCompile("")
+	port := regexp.MustCompile("^9001$")
+	tests := []struct {
+		match prxConfig.Match
+		want  string
+	}{
+		{prxConfig.Match{Header: map[string]*regexp.Regexp{"D": anything, "B": anything, "C": anything, "A": anything}}, "match.header.A"},
+		{prxConfig.Match{Query: map[string]*regexp.Regexp{"d": anything, "b": anything, "c": anything, "a": anything}}, "match.query.a"},
+		{prxConfig.Match{ClientPort: port}, ""},
+		{prxConfig.Match{ClientPort: regexp.MustCompile("^9002$")}, "match.clientPort"},
+	}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.1:50000"
+	proxyAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 9001}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, proxyAddr))
+	for _, test := range tests {
+		entry := prxConfig.Entry{URL: anything, Match: &test.match}
+		// Maps are ranged in a random order, the answer must not change.
+		for i := 0; i < 20; i++ {
+			if got := Mismatch(&entry, req, nil); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+				break
+			}
+		}
+	}
+}
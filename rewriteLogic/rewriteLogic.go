@@ -21,48 +21,108 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
 	"restfulHttpsProxy/prxConfig"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
-func applyStreamRule(input io.Reader, bufferSize int, rule prxConfig.Rule) io.Reader {
-	if rule.Find != nil && rule.Replace != nil {
-		input = RegexReader(input, bufferSize, rule.Find, []byte(*rule.Replace))
+// count adds n to counter, counter may be nil.
+func count(counter *int64, n int) {
+	if counter != nil && n > 0 {
+		atomic.AddInt64(counter, int64(n))
+	}
+}
+
+// replaceAllString is find.ReplaceAllString that also tells how many matches
+// were replaced.
+func replaceAllString(find *regexp.Regexp, src string, template string) (string, int) {
+	matches := find.FindAllStringSubmatchIndex(src, -1)
+	if len(matches) == 0 {
+		return src, 0
+	}
+	var dst []byte
+	last := 0
+	for _, match := range matches {
+		dst = append(dst, src[last:match[0]]...)
+		dst = find.ExpandString(dst, template, src, match)
+		last = match[1]
+	}
+	dst = append(dst, src[last:]...)
+	return string(dst), len(matches)
+}
+
+// replaceAll is find.ReplaceAll that also tells how many matches were
+// replaced. Like ReplaceAll it always returns a new slice.
+func replaceAll(find *regexp.Regexp, src []byte, template []byte) ([]byte, int) {
+	matches := find.FindAllSubmatchIndex(src, -1)
+	var dst []byte
+	last := 0
+	for _, match := range matches {
+		dst = append(dst, src[last:match[0]]...)
+		dst = find.Expand(dst, template, src, match)
+		last = match[1]
+	}
+	dst = append(dst, src[last:]...)
+	return dst, len(matches)
+}
+
+// applyStreamRule applies rule to input as it is read, the replacements are
+// added to counter, which may be nil.
+func applyStreamRule(input io.Reader, bufferSize int, rule prxConfig.Rule, counter *int64) io.Reader {
+	if rule.IsJSON() {
+		input = &jsonRuleReader{input: input, rule: rule, counter: counter}
+	} else if rule.Find != nil && rule.Replace != nil {
+		regexReader := RegexReader(input, bufferSize, rule.Find, []byte(*rule.Replace))
+		regexReader.chunkReader.counter = counter
+		input = regexReader
 	} else if rule.Replace != nil {
 		input = strings.NewReader(*rule.Replace)
+		count(counter, 1)
 	} else if rule.Prepend != nil { // remove else?
 		input = io.MultiReader(strings.NewReader(*rule.Prepend), input)
+		count(counter, 1)
 	} else if rule.Append != nil { // remove else?
-		input = io.MultiReader(input, strings.NewReader(*rule.Prepend))
+		input = io.MultiReader(input, strings.NewReader(*rule.Append))
+		count(counter, 1)
 	}
 	return input
 }
 
-func applyRule(input string, rule prxConfig.Rule) string {
+// applyRule returns input changed by rule and how many replacements were made.
+func applyRule(input string, rule prxConfig.Rule) (string, int) {
+	replaced := 0
 	if rule.Find != nil && rule.Replace != nil {
-		input = rule.Find.ReplaceAllString(input, *rule.Replace)
+		input, replaced = replaceAllString(rule.Find, input, *rule.Replace)
 	} else if rule.Replace != nil {
 		input = *rule.Replace
+		replaced = 1
 	} else if rule.Prepend != nil { // remove else?
 		input = *rule.Prepend + input
+		replaced = 1
 	} else if rule.Append != nil { // remove else?
 		input = input + *rule.Append
+		replaced = 1
 	}
-	return input
+	return input, replaced
 }
 
-func AlterURL(u *url.URL, URLRules []prxConfig.Rule) error {
+// AlterURL applies URLRules to u and returns how many replacements were made.
+func AlterURL(u *url.URL, URLRules []prxConfig.Rule) (int, error) {
 	urlStr := u.String()
+	replaced := 0
 	for _, URLRule := range URLRules {
-		urlStr = applyRule(urlStr, URLRule)
+		var n int
+		urlStr, n = applyRule(urlStr, URLRule)
+		replaced += n
 	}
 	newURL, err := url.Parse(urlStr)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	*u = *newURL //copy it
-	return nil
+	return replaced, nil
 }
 
 func headerGetKeyValue(headerStr string) (key string, value string) {
@@ -78,19 +138,25 @@ func headerGetKeyValue(headerStr string) (key string, value string) {
 	return
 }
 
-func AlterStatus(response *http.Response, statusRules []prxConfig.Rule) {
+// AlterStatus applies statusRules to response and returns how many
+// replacements were made, 0 if the new status is not valid.
+func AlterStatus(response *http.Response, statusRules []prxConfig.Rule) int {
 	statusStr := response.Status
+	replaced := 0
 	for _, statusRule := range statusRules {
-		statusStr = applyRule(statusStr, statusRule)
+		var n int
+		statusStr, n = applyRule(statusStr, statusRule)
+		replaced += n
 	}
 
 	s := strings.Split(statusStr, " ")
 	code, err := strconv.Atoi(s[0])
 	if err != nil {
-		return
+		return 0
 	}
 	response.Status = statusStr
 	response.StatusCode = code
+	return replaced
 }
 
 func headerToString(header http.Header) string {
@@ -120,14 +186,19 @@ func stringToHeader(str string) http.Header {
 	return header
 }
 
-func AlterHeader(header *http.Header, headerRules []prxConfig.Rule) error {
+// AlterHeader applies headerRules to header and returns how many
+// replacements were made.
+func AlterHeader(header *http.Header, headerRules []prxConfig.Rule) (int, error) {
 	if len(headerRules) <= 0 {
-		return nil
+		return 0, nil
 	}
 	headerStr := headerToString(*header)
 
+	replaced := 0
 	for _, headerRule := range headerRules {
-		headerStr = applyRule(headerStr, headerRule)
+		var n int
+		headerStr, n = applyRule(headerStr, headerRule)
+		replaced += n
 	}
 	if len(headerStr) < 1 || headerStr[0] != '\n' {
 		headerStr = "\n" + headerStr
@@ -137,7 +208,59 @@ func AlterHeader(header *http.Header, headerRules []prxConfig.Rule) error {
 	}
 	//log.Print("\nheader new\n----------\n" + headerStr + "\n")
 	*header = stringToHeader(headerStr)
-	return nil
+	return replaced, nil
+}
+
+// AlterHeaderOps applies ops to header in order and returns how many of them
+// changed something.
+func AlterHeaderOps(header http.Header, ops []prxConfig.HeaderOp) int {
+	changed := 0
+	for _, op := range ops {
+		switch op.Op {
+		case "set":
+			header[op.Name] = []string{op.Value}
+			changed++
+		case "add":
+			header[op.Name] = append(header[op.Name], op.Value)
+			changed++
+		case "remove":
+			if _, ok := header[op.Name]; ok {
+				delete(header, op.Name)
+				changed++
+			}
+		case "rename":
+			if values, ok := header[op.Name]; ok {
+				delete(header, op.Name)
+				header[op.To] = append(header[op.To], values...)
+				changed++
+			}
+		case "replace":
+			for i, value := range header[op.Name] {
+				var n int
+				header[op.Name][i], n = replaceAllString(op.Find, value, op.Replace)
+				changed += n
+			}
+		}
+	}
+	return changed
+}
+
+// AlterWebSocketMessage applies rules to the data of a WebSocket message. It
+// returns the new data, if the message is dropped, the messages the rules
+// inject after it and how many rules matched.
+func AlterWebSocketMessage(data []byte, rules []prxConfig.WebSocketRule) (altered []byte, drop bool, inject []prxConfig.WebSocketMessage, matched int) {
+	for _, rule := range rules {
+		if rule.Find != nil && !rule.Find.Match(data) {
+			continue
+		}
+		matched++
+		if rule.Replace != nil {
+			data, _ = replaceAll(rule.Find, data, []byte(*rule.Replace))
+		}
+		drop = drop || rule.Drop
+		inject = append(inject, rule.Inject...)
+	}
+	return data, drop, inject, matched
 }
 
 type readCloser struct {
@@ -145,7 +268,9 @@ type readCloser struct {
 	dataCloser io.Closer
 }
 
-func AlterBody(r io.ReadCloser, bufferSize int, rules []prxConfig.Rule) io.ReadCloser {
+// AlterBody applies rules to r as it is read. The replacements are added to
+// counter as they are made, it may be nil.
+func AlterBody(r io.ReadCloser, bufferSize int, rules []prxConfig.Rule, counter *int64) io.ReadCloser {
 	if rules == nil || len(rules) == 0 {
 		return r
 	}
@@ -156,7 +281,7 @@ func AlterBody(r io.ReadCloser, bufferSize int, rules []prxConfig.Rule) io.ReadC
 	reader = r
 
 	for _, rule := range rules {
-		reader = applyStreamRule(reader, bufferSize, rule)
+		reader = applyStreamRule(reader, bufferSize, rule, counter)
 	}
 
 	rc.data = reader
@@ -0,0 +1,89 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rewriteLogic
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"restfulHttpsProxy/prxConfig"
+	"strings"
+	"testing"
+)
+
+func str(s string) *string {
+	return &s
+}
+
+func TestAlterBody(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  prxConfig.Rule
+		want  string
+		count int64
+	}{
+		{"append", prxConfig.Rule{Append: str(" end")}, "hello world end", 1},
+		{"prepend", prxConfig.Rule{Prepend: str("start ")}, "start hello world", 1},
+		{"replace", prxConfig.Rule{Replace: str("bye")}, "bye", 1},
+		{"find", prxConfig.Rule{Find: regexp.MustCompile("o"), Replace: str("0")}, "hell0 w0rld", 2},
+	}
+	for _, test := range tests {
+		var count int64
+		body := AlterBody(ioutil.NopCloser(strings.NewReader("hello world")), 1024, []prxConfig.Rule{test.rule}, &count)
+		got, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if string(got) != test.want || count != test.count {
+			t.Errorf("%s: got %q and %d replacements, want %q and %d", test.name, got, count, test.want, test.count)
+		}
+	}
+}
+
+func TestAlterHeaderOps(t *testing.T) {
+	set := prxConfig.HeaderOp{Op: "set", Name: "X-A", Value: "set"}
+	add := prxConfig.HeaderOp{Op: "add", Name: "X-A", Value: "added"}
+	remove := prxConfig.HeaderOp{Op: "remove", Name: "X-A"}
+	rename := prxConfig.HeaderOp{Op: "rename", Name: "X-A", To: "X-B"}
+	replace := prxConfig.HeaderOp{Op: "replace", Name: "X-A", Find: regexp.MustCompile("o"), Replace: "0"}
+	tests := []struct {
+		name    string
+		ops     []prxConfig.HeaderOp
+		want    http.Header
+		changed int
+	}{
+		{"set", []prxConfig.HeaderOp{set}, http.Header{"X-A": {"set"}, "X-B": {"b"}}, 1},
+		{"add", []prxConfig.HeaderOp{add}, http.Header{"X-A": {"one", "two", "added"}, "X-B": {"b"}}, 1},
+		{"remove", []prxConfig.HeaderOp{remove}, http.Header{"X-B": {"b"}}, 1},
+		{"remove missing", []prxConfig.HeaderOp{remove, remove}, http.Header{"X-B": {"b"}}, 1},
+		{"rename", []prxConfig.HeaderOp{rename}, http.Header{"X-B": {"b", "one", "two"}}, 1},
+		{"replace", []prxConfig.HeaderOp{replace}, http.Header{"X-A": {"0ne", "tw0"}, "X-B": {"b"}}, 2},
+		{"set then add", []prxConfig.HeaderOp{set, add}, http.Header{"X-A": {"set", "added"}, "X-B": {"b"}}, 2},
+		{"add then set", []prxConfig.HeaderOp{add, set}, http.Header{"X-A": {"set"}, "X-B": {"b"}}, 2},
+		{"set then remove", []prxConfig.HeaderOp{set, remove}, http.Header{"X-B": {"b"}}, 2},
+		{"remove then add", []prxConfig.HeaderOp{remove, add}, http.Header{"X-A": {"added"}, "X-B": {"b"}}, 2},
+		{"rename then set", []prxConfig.HeaderOp{rename, set}, http.Header{"X-A": {"set"}, "X-B": {"b", "one", "two"}}, 2},
+	}
+	for _, test := range tests {
+		header := http.Header{"X-A": {"one", "two"}, "X-B": {"b"}}
+		changed := AlterHeaderOps(header, test.ops)
+		if !reflect.DeepEqual(header, test.want) || changed != test.changed {
+			t.Errorf("%s: got %v and %d changes, want %v and %d", test.name, header, changed, test.want, test.changed)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rewriteLogic
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"restfulHttpsProxy/prxConfig"
+)
+
+// Size of the reads of streamed bodies, a read returns as soon as some data
+// came, so it is only an upper bound.
+const streamReadSize = 32 * 1024
+
+// Events bigger than this are passed on as they are.
+const maxEventSize = 1 << 20
+
+// applyPartRule applies rule to data, a part of a body or the data of an
+// event, and returns how many replacements were made. Data that is not JSON
+// is left as it is by the JSON rules.
+func applyPartRule(data []byte, rule prxConfig.Rule) ([]byte, int) {
+	if rule.IsJSON() {
+		newData, err := applyJSONRule(data, rule)
+		if err != nil {
+			return data, 0
+		}
+		return newData, 1
+	}
+	newData, replaced := applyRule(string(data), rule)
+	return []byte(newData), replaced
+}
+
+// streamRuleReader applies rule to every line of data on its own, as soon as
+// the line is complete, so that a line is never held back by the next one.
+// Lines are cut at maxEventSize.
+type streamRuleReader struct {
+	data    io.Reader
+	rule    prxConfig.Rule
+	counter *int64
+
+	buf     []byte
+	partial []byte // the start of a line not complete yet
+	pending []byte // rewritten lines not returned yet
+	err     error
+}
+
+func (r *streamRuleReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 && r.err == nil {
+		if r.buf == nil {
+			r.buf = make([]byte, streamReadSize)
+		}
+		var n int
+		n, r.err = r.data.Read(r.buf)
+		r.partial = append(r.partial, r.buf[:n]...)
+		complete := bytes.LastIndexByte(r.partial, '\n') + 1
+		if r.err != nil || len(r.partial) > maxEventSize {
+			complete = len(r.partial)
+		}
+		if complete > 0 {
+			r.pending = r.rewriteLines(r.partial[:complete])
+			r.partial = append([]byte(nil), r.partial[complete:]...)
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	if len(r.pending) > 0 {
+		return n, nil
+	}
+	return n, r.err
+}
+
+// rewriteLines applies the rule to every line of lines, without its line
+// ending, so that $ and JSON documents work like on a whole body.
+func (r *streamRuleReader) rewriteLines(lines []byte) []byte {
+	var rewritten []byte
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) == 0 {
+			continue // after the last line ending
+		}
+		content := bytes.TrimRight(line, "\r\n")
+		newContent, replaced := applyPartRule(content, r.rule)
+		count(r.counter, replaced)
+		rewritten = append(rewritten, newContent...)
+		rewritten = append(rewritten, line[len(content):]...)
+	}
+	return rewritten
+}
+
+// AlterStream is AlterBody for bodies that must reach the client as they
+// come, like long polls and streams of JSON lines. The find and JSON rules
+// are applied to every line on its own, the others like in AlterBody.
+func AlterStream(r io.ReadCloser, rules []prxConfig.Rule, counter *int64) io.ReadCloser {
+	if len(rules) == 0 {
+		return r
+	}
+	var reader io.Reader = r
+	for _, rule := range rules {
+		if rule.IsJSON() || rule.Find != nil {
+			reader = &streamRuleReader{data: reader, rule: rule, counter: counter}
+		} else {
+			reader = applyStreamRule(reader, streamReadSize, rule, counter)
+		}
+	}
+	return &readCloser{data: reader, dataCloser: r}
+}
+
+// eventReader applies rules to the data of every server-sent event, an
+// event is passed on as soon as the blank line that ends it is read.
+type eventReader struct {
+	src     *bufio.Reader
+	rules   []prxConfig.Rule
+	counter *int64
+
+	pending []byte // rewritten events not returned yet
+	err     error
+}
+
+func (r *eventReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 && r.err == nil {
+		var event []byte
+		var complete bool
+		event, complete, r.err = r.readEvent()
+		if complete {
+			event = r.rewriteEvent(event)
+		}
+		r.pending = event
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	if len(r.pending) > 0 {
+		return n, nil
+	}
+	return n, r.err
+}
+
+// readEvent returns the lines of an event up to and with the blank line
+// that ends it. The event is not complete if the stream ended first or if
+// it is bigger than maxEventSize.
+func (r *eventReader) readEvent() (event []byte, complete bool, err error) {
+	for {
+		line, err := r.src.ReadBytes('\n')
+		event = append(event, line...)
+		if err != nil {
+			return event, false, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return event, true, nil
+		}
+		if len(event) > maxEventSize {
+			return event, false, nil
+		}
+	}
+}
+
+// dataField returns the value of a data line, see
+// https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+func dataField(line []byte) ([]byte, bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if !bytes.HasPrefix(line, []byte("data")) {
+		return nil, false
+	}
+	value := line[len("data"):]
+	if len(value) == 0 {
+		return value, true
+	}
+	if value[0] != ':' {
+		return nil, false
+	}
+	return bytes.TrimPrefix(value[1:], []byte(" ")), true
+}
+
+// rewriteEvent applies the rules to the data of event, the data lines are
+// joined with newlines like the client joins them. The other lines are kept
+// as they are, an event without data is passed on untouched and one whose
+// data the rules emptied is dropped.
+func (r *eventReader) rewriteEvent(event []byte) []byte {
+	lines := bytes.SplitAfter(event, []byte("\n"))
+	var values [][]byte
+	for _, line := range lines {
+		if value, ok := dataField(line); ok {
+			values = append(values, value)
+		}
+	}
+	if values == nil {
+		return event
+	}
+	original := bytes.Join(values, []byte("\n"))
+	data := original
+	for _, rule := range r.rules {
+		var replaced int
+		data, replaced = applyPartRule(data, rule)
+		count(r.counter, replaced)
+	}
+	if bytes.Equal(data, original) {
+		return event
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	var rewritten []byte
+	dataWritten := false
+	for _, line := range lines {
+		if _, ok := dataField(line); !ok {
+			rewritten = append(rewritten, line...)
+			continue
+		}
+		if dataWritten {
+			continue
+		}
+		for _, value := range bytes.Split(data, []byte("\n")) {
+			rewritten = append(rewritten, "data: "...)
+			rewritten = append(rewritten, value...)
+			rewritten = append(rewritten, '\n')
+		}
+		dataWritten = true
+	}
+	return rewritten
+}
+
+// AlterEvents applies rules to the data of every event of a server-sent
+// events body, as the events come. The replacements are added to counter,
+// it may be nil.
+func AlterEvents(r io.ReadCloser, rules []prxConfig.Rule, counter *int64) io.ReadCloser {
+	if len(rules) == 0 {
+		return r
+	}
+	reader := &eventReader{
+		src:     bufio.NewReaderSize(r, streamReadSize),
+		rules:   rules,
+		counter: counter,
+	}
+	return &readCloser{data: reader, dataCloser: r}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rewriteLogic
+
+import (
+	"io"
+	"io/ioutil"
+	"regexp"
+	"restfulHttpsProxy/jsonPath"
+	"restfulHttpsProxy/prxConfig"
+	"testing"
+	"time"
+)
+
+// chunkReader returns one chunk per read, like a server that sends them
+// one by one.
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func findRule(find string, replace string) prxConfig.Rule {
+	return prxConfig.Rule{Find: regexp.MustCompile(find), Replace: str(replace)}
+}
+
+func TestAlterStream(t *testing.T) {
+	path, err := jsonPath.Parse("$.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		chunks []string
+		rule   prxConfig.Rule
+		want   string
+		count  int64
+	}{
+		{"split match", []string{"{\"score\": 1}\n{\"sc", "ore\": 2}\n"}, findRule("score", "SCORE"), "{\"SCORE\": 1}\n{\"SCORE\": 2}\n", 2},
+		{"json lines", []string{"{\"a\": 0}\n{\"a\"", ": 5}\n"}, prxConfig.Rule{JSONSet: path, Value: float64(1)}, "{\"a\":1}\n{\"a\":1}\n", 2},
+		{"no line ending", []string{"a", "bc"}, findRule("b", "X"), "aXc", 1},
+		{"end of line", []string{"a1\r\nb1", "\r\n"}, findRule("1$", "2"), "a2\r\nb2\r\n", 2},
+	}
+	for _, test := range tests {
+		var count int64
+		body := AlterStream(ioutil.NopCloser(&chunkReader{test.chunks}), []prxConfig.Rule{test.rule}, &count)
+		got, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if string(got) != test.want || count != test.count {
+			t.Errorf("%s: got %q and %d replacements, want %q and %d", test.name, got, count, test.want, test.count)
+		}
+	}
+}
+
+func TestAlterEvents(t *testing.T) {
+	secret := findRule("secret", "public")
+	tests := []struct {
+		name   string
+		chunks []string
+		rule   prxConfig.Rule
+		want   string
+	}{
+		{"one event", []string{"id: 1\ndata: secret\n\n"}, secret, "id: 1\ndata: public\n\n"},
+		{"split event", []string{"data: sec", "ret\n", "\n"}, secret, "data: public\n\n"},
+		{"no space", []string{"data:secret\n\n"}, secret, "data: public\n\n"},
+		{"multi-line data", []string{"data: line one\ndata: secret two\n\n"}, secret, "data: line one\ndata: public two\n\n"},
+		{"joined data", []string{"data: one\ndata: two\n\n"}, findRule(`^(.*)\n(.*)$`, "$2\n$1"), "data: two\ndata: one\n\n"},
+		{"keep-alive", []string{": keep-alive\n\n", "data: secret\n\n"}, secret, ": keep-alive\n\ndata: public\n\n"},
+		{"comment", []string{": c\nevent: score\ndata: secret\nid: 2\n\n"}, secret, ": c\nevent: score\ndata: public\nid: 2\n\n"},
+		{"emptied event", []string{"data: secret\n\ndata: b\n\n"}, findRule("^secret$", ""), "data: b\n\n"},
+		{"unchanged", []string{"data:  spaced\r\n\r\n"}, secret, "data:  spaced\r\n\r\n"},
+		{"cut off", []string{"data: secret\n"}, secret, "data: secret\n"},
+	}
+	for _, test := range tests {
+		body := AlterEvents(ioutil.NopCloser(&chunkReader{test.chunks}), []prxConfig.Rule{test.rule}, nil)
+		got, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// TestStreamsAreNotHeldBack checks that what is complete is read before the
+// server sends the rest.
+func TestStreamsAreNotHeldBack(t *testing.T) {
+	secret := []prxConfig.Rule{findRule("secret", "public")}
+	tests := []struct {
+		name  string
+		alter func(io.ReadCloser) io.ReadCloser
+		first string
+		want  string
+	}{
+		{"events", func(r io.ReadCloser) io.ReadCloser { return AlterEvents(r, secret, nil) }, "data: secret\n\n", "data: public\n\n"},
+		{"lines", func(r io.ReadCloser) io.ReadCloser { return AlterStream(r, secret, nil) }, "a secret\n", "a public\n"},
+	}
+	for _, test := range tests {
+		pr, pw := io.Pipe()
+		body := test.alter(pr)
+		go pw.Write([]byte(test.first))
+
+		read := make(chan string)
+		go func() {
+			buf := make([]byte, 1024)
+			n, _ := body.Read(buf)
+			read <- string(buf[:n])
+		}()
+		select {
+		case got := <-read:
+			if got != test.want {
+				t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: held back until the server closes", test.name)
+		}
+		pw.Close()
+	}
+}
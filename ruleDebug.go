@@ -0,0 +1,131 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"restfulHttpsProxy/prxConfig"
+	"restfulHttpsProxy/rewriteLogic"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const rulesAppliedHeader = "X-Proxy-Rules-Applied"
+
+// Sessions in debug mode, see startDebug.
+var debugSessions sync.Map
+
+// startDebug makes the proxy report what the rules of session did, in the
+// rulesAppliedHeader of every response and in the ruleHits of the log.
+func startDebug(session string) {
+	debugSessions.Store(session, true)
+}
+
+func stopDebug(session string) {
+	debugSessions.Delete(session)
+}
+
+func isDebugging(session string) bool {
+	_, ok := debugSessions.Load(session)
+	return ok
+}
+
+// ruleLog tells what one rule did to a round trip, the numbers are the
+// replacements its rewrite made in every part, and the WebSocket messages
+// its webSocket rules matched.
+type ruleLog struct {
+	ID       string `json:"id"`
+	Matched  bool   `json:"matched"`
+	Mismatch string `json:"mismatch,omitempty"` // the part of the rule that did not fit, like url or match.header.Accept
+
+	URL            int64 `json:"url"`
+	RequestHeader  int64 `json:"requestHeader"`
+	RequestBody    int64 `json:"requestBody"`
+	Status         int64 `json:"status"`
+	ResponseHeader int64 `json:"responseHeader"`
+	ResponseBody   int64 `json:"responseBody"`
+	ResponseEvents int64 `json:"responseEvents"`
+	WebSocket      int64 `json:"webSocket"`
+}
+
+// matchRules checks every rule against req before any of them rewrites it.
+func matchRules(rules prxConfig.RewriteRules, req *http.Request, body []byte) []ruleLog {
+	logs := make([]ruleLog, len(rules))
+	for i := range rules {
+		logs[i].ID = rules[i].ID
+		logs[i].Mismatch = rewriteLogic.Mismatch(&rules[i], req, body)
+		logs[i].Matched = logs[i].Mismatch == ""
+	}
+	return logs
+}
+
+// snapshotRuleLogs copies logs, the body counts may still be written while the
+// bodies are read.
+func snapshotRuleLogs(logs []ruleLog) []ruleLog {
+	snapshot := make([]ruleLog, len(logs))
+	for i := range logs {
+		snapshot[i] = ruleLog{
+			ID:             logs[i].ID,
+			Matched:        logs[i].Matched,
+			Mismatch:       logs[i].Mismatch,
+			URL:            logs[i].URL,
+			RequestHeader:  logs[i].RequestHeader,
+			RequestBody:    atomic.LoadInt64(&logs[i].RequestBody),
+			Status:         logs[i].Status,
+			ResponseHeader: logs[i].ResponseHeader,
+			ResponseBody:   atomic.LoadInt64(&logs[i].ResponseBody),
+			ResponseEvents: atomic.LoadInt64(&logs[i].ResponseEvents),
+			WebSocket:      atomic.LoadInt64(&logs[i].WebSocket),
+		}
+	}
+	return snapshot
+}
+
+// rulesApplied is the value of the rulesAppliedHeader, the ids of the
+// matched rules, each with the replacements known when the response headers
+// are sent, like "3g, 9f86d081;url=1;status=1". It is "none" if no rule matched.
+func rulesApplied(logs []ruleLog) string {
+	var applied []string
+	for i := range logs {
+		if !logs[i].Matched {
+			continue
+		}
+		rule := logs[i].ID
+		counts := []struct {
+			name  string
+			count int64
+		}{
+			{"url", logs[i].URL},
+			{"requestHeader", logs[i].RequestHeader},
+			{"requestBody", atomic.LoadInt64(&logs[i].RequestBody)},
+			{"status", logs[i].Status},
+			{"responseHeader", logs[i].ResponseHeader},
+		}
+		for _, c := range counts {
+			if c.count > 0 {
+				rule += ";" + c.name + "=" + strconv.FormatInt(c.count, 10)
+			}
+		}
+		applied = append(applied, rule)
+	}
+	if len(applied) == 0 {
+		return "none"
+	}
+	return strings.Join(applied, ", ")
+}
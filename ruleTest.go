@@ -0,0 +1,262 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"restfulHttpsProxy/proxy"
+	"restfulHttpsProxy/prxConfig"
+	"strconv"
+	"strings"
+)
+
+// ruleTest is the body of /api/rules/test. Request and Response are either
+// raw HTTP in a string or objects like in the log.
+type ruleTest struct {
+	Config   json.RawMessage `json:"config,omitempty"` // the rules of the session if not set
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response,omitempty"` // an empty 200 OK if not set
+}
+
+type ruleTestResult struct {
+	Request  requestLog  `json:"request"`  // the request as it would be sent to the server
+	Response responseLog `json:"response"` // the response as it would be sent to the client
+	Rules    []string    `json:"rules"`    // ids of the rules that matched
+	RuleHits []ruleLog   `json:"ruleHits"`
+}
+
+// testRules runs the request and response of test through its rules, the
+// same way the proxy does, but without sending anything. Throttles, delays
+// and faults are not applied.
+func testRules(test ruleTest, session string) (*ruleTestResult, error) {
+	config := getRules(session)
+	if len(test.Config) > 0 {
+		var err error
+		if config, err = prxConfig.ParseConfig(test.Config); err != nil {
+			return nil, err
+		}
+	}
+	// Rules without id are named after their place, so that the result is
+	// the same every time.
+	for i := range config.Rules {
+		if config.Rules[i].ID == "" {
+			config.Rules[i].ID = "#" + strconv.Itoa(i)
+		}
+	}
+	if err := assignRuleIDs(&config); err != nil {
+		return nil, err
+	}
+	rules, err := prxConfig.Compile(config)
+	if err != nil {
+		return nil, err
+	}
+
+	req, reqBody, err := parseTestRequest(test.Request)
+	if err != nil {
+		return nil, errors.New("request: " + err.Error())
+	}
+	if !rules.NeedsRequestBody() {
+		reqBody = nil
+	} else if len(reqBody) > maxMatchedBodySize {
+		reqBody = reqBody[:maxMatchedBodySize]
+	}
+
+	result := &ruleTestResult{Rules: []string{}}
+	logs := matchRules(rules, req, reqBody)
+	var respond *prxConfig.Respond
+	for i := range rules {
+		if !logs[i].Matched {
+			continue
+		}
+		result.Rules = append(result.Rules, logs[i].ID)
+		if respond == nil {
+			respond = rules[i].Respond
+		}
+		if err := rewriteRequest(&rules[i], req, &logs[i]); err != nil {
+			return nil, err
+		}
+	}
+	req.Host = req.URL.Host
+	result.Request = snapshotRequest(req)
+	result.Request.Timestamp = 0
+	result.Request.setBody(readTestBody(req.Body))
+
+	var resp *http.Response
+	if respond != nil {
+		resp, err = mockResponse(req, respond)
+	} else {
+		resp, err = parseTestResponse(test.Response, req)
+		if err != nil {
+			err = errors.New("response: " + err.Error())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	streamed := streamsResponse(rules, logs, resp)
+	for i := range rules {
+		if logs[i].Matched {
+			rewriteResponse(&rules[i], resp, &logs[i], streamed)
+		}
+	}
+	result.Response = snapshotResponse(resp)
+	result.Response.Timestamp = 0
+	result.Response.setBody(readTestBody(resp.Body))
+	result.RuleHits = logs
+	return result, nil
+}
+
+func readTestBody(body io.ReadCloser) *limitedBuffer {
+	buf := &limitedBuffer{limit: maxLoggedBodySize}
+	if body != nil {
+		io.Copy(buf, body)
+		body.Close()
+	}
+	return buf
+}
+
+// rawHTTP returns the string in data, or false if data is not a JSON string.
+func rawHTTP(data json.RawMessage) (string, bool) {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return "", false
+	}
+	// A blank line after the headers is easy to forget.
+	if !strings.Contains(raw, "\n\n") && !strings.Contains(raw, "\r\n\r\n") {
+		raw += "\r\n\r\n"
+	}
+	return raw, true
+}
+
+func parseLoggedHeaders(headers string) (http.Header, error) {
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(headers + "\r\n"))).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return http.Header(header), nil
+}
+
+func decodeLoggedBody(body string, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+// parseTestRequest returns the request in data and its body. Raw requests
+// with a path instead of a URL go to https on their Host.
+func parseTestRequest(data json.RawMessage) (*http.Request, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errors.New("missing")
+	}
+	var req *http.Request
+	var body []byte
+	if raw, ok := rawHTTP(data); ok {
+		reader := bufio.NewReader(strings.NewReader(raw))
+		var err error
+		req, err = http.ReadRequest(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(body) == 0 {
+			// Without Content-Length everything after the headers is the body.
+			body, _ = ioutil.ReadAll(reader)
+		}
+		req.RequestURI = ""
+		if !req.URL.IsAbs() {
+			req.URL.Scheme = "https"
+			req.URL.Host = req.Host
+		}
+	} else {
+		var logged requestLog
+		err := json.Unmarshal(data, &logged)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err = decodeLoggedBody(logged.Body, logged.BodyEncoding)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err = http.NewRequest(logged.Method, logged.URL, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header, err = parseLoggedHeaders(logged.Headers)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return req, body, nil
+}
+
+// parseTestResponse returns the response to req in data.
+func parseTestResponse(data json.RawMessage, req *http.Request) (*http.Response, error) {
+	resp := proxy.NewResponse(req)
+	resp.Status = "200 OK"
+	var body []byte
+	if len(data) == 0 {
+		// An empty response, for rules that only look at the request.
+	} else if raw, ok := rawHTTP(data); ok {
+		var err error
+		resp, err = http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), req)
+		if err != nil {
+			return nil, err
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var logged responseLog
+		err := json.Unmarshal(data, &logged)
+		if err != nil {
+			return nil, err
+		}
+		if logged.Status != "" {
+			resp.Status = logged.Status
+			resp.StatusCode, err = strconv.Atoi(strings.SplitN(logged.Status, " ", 2)[0])
+			if err != nil {
+				return nil, errors.New("Illegal status " + logged.Status)
+			}
+		}
+		resp.Header, err = parseLoggedHeaders(logged.Headers)
+		if err != nil {
+			return nil, err
+		}
+		body, err = decodeLoggedBody(logged.Body, logged.BodyEncoding)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testedRules = `{"rules": [
+	{"id": "secret", "url": "example\\.com/api", "match": {"method": "POST"}, "rewrite": {"response": {"body": [{"find": "secret", "replace": "public"}]}}},
+	{"id": "xml", "url": "example\\.com", "match": {"header": {"Accept": "xml"}}, "respond": {"status": 500}}
+]}`
+
+func TestRuleTestAPI(t *testing.T) {
+	body := `{
+		"config": ` + testedRules + `,
+		"request": "POST /api/a HTTP/1.1\r\nHost: example.com\r\nAccept: json\r\n\r\nhi",
+		"response": {"status": "200 OK", "headers": "Content-Type: text/plain", "body": "a secret"}
+	}`
+	resp, respBody := callAPI("POST", "/api/rules/test", body, "me")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", resp.StatusCode, respBody)
+	}
+	var result ruleTestResult
+	if err := json.Unmarshal([]byte(respBody), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rules) != 1 || result.Rules[0] != "secret" {
+		t.Errorf("got matching rules %v, want [secret]", result.Rules)
+	}
+	if len(result.RuleHits) != 2 {
+		t.Fatalf("got %d rule hits, want 2", len(result.RuleHits))
+	}
+	if hit := result.RuleHits[0]; !hit.Matched || hit.ResponseBody != 1 {
+		t.Errorf("got %+v for the matching rule", hit)
+	}
+	if hit := result.RuleHits[1]; hit.Matched || hit.Mismatch != "match.header.Accept" {
+		t.Errorf("got %+v for the rule that does not match, want the mismatch match.header.Accept", hit)
+	}
+	if result.Request.Method != "POST" || result.Request.URL != "https://example.com/api/a" || result.Request.Body != "hi" {
+		t.Errorf("got request %+v", result.Request)
+	}
+	if result.Response.Status != "200 OK" || result.Response.Body != "a public" {
+		t.Errorf("got response %+v", result.Response)
+	}
+}
+
+func TestRuleTestAPIErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"not json", `{"request": `, "unexpected EOF"},
+		{"unknown key", `{"req": "GET / HTTP/1.1"}`, "unknown field"},
+		{"no request", `{"config": {"rules": []}}`, "request: missing"},
+		{"not http", `{"config": {"rules": []}, "request": "hello"}`, "request: "},
+		{"bad response", `{"config": {"rules": []}, "request": "GET http://example.com/ HTTP/1.1", "response": {"status": "OK"}}`, "response: Illegal status OK"},
+	}
+	for _, test := range tests {
+		resp, respBody := callAPI("POST", "/api/rules/test", test.body, "me")
+		if resp.StatusCode == http.StatusOK || !strings.Contains(respBody, test.want) {
+			t.Errorf("%s: got %d %q, want an error with %q", test.name, resp.StatusCode, respBody, test.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"restfulHttpsProxy/jsonPath"
+	"restfulHttpsProxy/prxConfig"
+	"restfulHttpsProxy/rewriteLogic"
+	"sync"
+	"time"
+)
+
+// Held while the rules of a client are read, changed and compiled, so that
+// concurrent changes don't overwrite each other.
+var rulesMu sync.Mutex
+
+// setRules compiles config and makes it the rules of session.
+func setRules(session string, config prxConfig.Config) error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	return setRulesLocked(session, config)
+}
+
+func setRulesLocked(session string, config prxConfig.Config) error {
+	if err := assignRuleIDs(&config); err != nil {
+		return err
+	}
+	newRewriteRules, err := prxConfig.Compile(config)
+	if err != nil {
+		return err
+	}
+	old, _ := rewriteRules.Load(session)
+	if len(config.Rules) > 0 {
+		source, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		rewriteRules.Store(session, newRewriteRules)
+		now := time.Now()
+		lastTimeUsed.Store(session, now)
+		storeRules(session, source, now)
+	} else {
+		rewriteRules.Delete(session)
+		forgetRules(session)
+	}
+	oldRules, _ := old.(prxConfig.RewriteRules)
+	forgetRuleHits(oldRules)
+
+	throttledConnections.Delete(session)
+	faultCounters.Delete(session)
+	return nil
+}
+
+// getRules returns the config the rules of session were compiled from.
+func getRules(session string) prxConfig.Config {
+	var config prxConfig.Config
+	if val, ok := rulesSource.Load(session); ok {
+		json.Unmarshal(val.([]byte), &config)
+	}
+	config.Session = nil
+	config.IP = nil
+	if config.Rules == nil {
+		config.Rules = []prxConfig.EntryJSON{}
+	}
+	return config
+}
+
+// updateRules lets update change the config of session, the new config is only
+// used if it compiles.
+func updateRules(session string, update func(config *prxConfig.Config) error) error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	config := getRules(session)
+	if err := update(&config); err != nil {
+		return err
+	}
+	return setRulesLocked(session, config)
+}
+
+// Rules without an id get a random one, so that they can be changed one by one.
+func assignRuleIDs(config *prxConfig.Config) error {
+	used := make(map[string]bool)
+	for _, entry := range config.Rules {
+		if entry.ID == "" {
+			continue
+		}
+		if used[entry.ID] {
+			return errors.New("More than one rule with id " + entry.ID)
+		}
+		used[entry.ID] = true
+	}
+	for i := range config.Rules {
+		for config.Rules[i].ID == "" {
+			id := fmt.Sprintf("%08x", rand.Uint32())
+			if !used[id] {
+				config.Rules[i].ID = id
+				used[id] = true
+			}
+		}
+	}
+	return nil
+}
+
+func findRule(config *prxConfig.Config, id string) (int, error) {
+	for i, entry := range config.Rules {
+		if entry.ID == id {
+			return i, nil
+		}
+	}
+	return -1, errors.New("No rule with id " + id)
+}
+
+func addRule(session string, entry prxConfig.EntryJSON, index int) (string, error) {
+	var id string
+	err := updateRules(session, func(config *prxConfig.Config) error {
+		if index < 0 || index > len(config.Rules) {
+			index = len(config.Rules)
+		}
+		config.Rules = append(config.Rules, prxConfig.EntryJSON{})
+		copy(config.Rules[index+1:], config.Rules[index:])
+		config.Rules[index] = entry
+		if err := assignRuleIDs(config); err != nil {
+			return err
+		}
+		id = config.Rules[index].ID
+		return nil
+	})
+	return id, err
+}
+
+// patchRule applies a JSON Merge Patch to the rule with id.
+func patchRule(session string, id string, patch []byte) error {
+	patchDoc, err := jsonPath.Decode(patch)
+	if err != nil {
+		return err
+	}
+	return updateRules(session, func(config *prxConfig.Config) error {
+		i, err := findRule(config, id)
+		if err != nil {
+			return err
+		}
+		entryBytes, err := json.Marshal(config.Rules[i])
+		if err != nil {
+			return err
+		}
+		entryDoc, err := jsonPath.Decode(entryBytes)
+		if err != nil {
+			return err
+		}
+		entryBytes, err = json.Marshal(rewriteLogic.MergePatch(entryDoc, patchDoc))
+		if err != nil {
+			return err
+		}
+		entry, err := prxConfig.ParseEntry(entryBytes)
+		if err != nil {
+			return err
+		}
+		if entry.ID != id {
+			return errors.New("The id of a rule cannot be changed")
+		}
+		config.Rules[i] = entry
+		return nil
+	})
+}
+
+func setRuleDisabled(session string, id string, disabled bool) error {
+	return updateRules(session, func(config *prxConfig.Config) error {
+		i, err := findRule(config, id)
+		if err != nil {
+			return err
+		}
+		if disabled {
+			config.Rules[i].Disabled = &disabled
+		} else {
+			config.Rules[i].Disabled = nil
+		}
+		return nil
+	})
+}
+
+func deleteRule(session string, id string) error {
+	return updateRules(session, func(config *prxConfig.Config) error {
+		i, err := findRule(config, id)
+		if err != nil {
+			return err
+		}
+		config.Rules = append(config.Rules[:i], config.Rules[i+1:]...)
+		return nil
+	})
+}
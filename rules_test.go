@@ -0,0 +1,82 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"restfulHttpsProxy/prxConfig"
+	"strings"
+	"testing"
+)
+
+func TestRuleAPI(t *testing.T) {
+	useTempSessionDir(t)
+	session := "rules"
+	defer setRules(session, prxConfig.Config{})
+	ruleURLs := func() string {
+		urls := []string{}
+		for _, entry := range getRules(session).Rules {
+			url := entry.ID + "="
+			if entry.URL != nil {
+				url += *entry.URL
+			}
+			if entry.Disabled != nil && *entry.Disabled {
+				url += "(disabled)"
+			}
+			urls = append(urls, url)
+		}
+		return strings.Join(urls, " ")
+	}
+
+	steps := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+		rules  string
+	}{
+		{"add", "/api/rules/add", `{"id": "a", "url": "a"}`, http.StatusOK, "a=a"},
+		{"add last", "/api/rules/add", `{"id": "c", "url": "c"}`, http.StatusOK, "a=a c=c"},
+		{"add at index", "/api/rules/add?index=1", `{"id": "b", "url": "b"}`, http.StatusOK, "a=a b=b c=c"},
+		{"add same id", "/api/rules/add", `{"id": "b", "url": "x"}`, http.StatusNotFound, "a=a b=b c=c"},
+		{"add wrong rule", "/api/rules/add", `{"url": "("}`, http.StatusNotFound, "a=a b=b c=c"},
+		{"update", "/api/rules/update?id=b", `{"url": "b2"}`, http.StatusOK, "a=a b=b2 c=c"},
+		{"update id", "/api/rules/update?id=b", `{"id": "d"}`, http.StatusNotFound, "a=a b=b2 c=c"},
+		{"update unknown id", "/api/rules/update?id=x", `{"url": "x"}`, http.StatusNotFound, "a=a b=b2 c=c"},
+		{"disable", "/api/rules/disable?id=a", "", http.StatusOK, "a=a(disabled) b=b2 c=c"},
+		{"enable", "/api/rules/enable?id=a", "", http.StatusOK, "a=a b=b2 c=c"},
+		{"delete", "/api/rules/delete?id=b", "", http.StatusOK, "a=a c=c"},
+		{"delete unknown id", "/api/rules/delete?id=b", "", http.StatusNotFound, "a=a c=c"},
+		{"clear", "/api/rules/clear", "", http.StatusOK, ""},
+	}
+	for _, step := range steps {
+		resp, body := callAPI("POST", step.path, step.body, session)
+		if resp.StatusCode != step.status {
+			t.Errorf("%s: got %d %q, want %d", step.name, resp.StatusCode, body, step.status)
+		}
+		if got := ruleURLs(); got != step.rules {
+			t.Errorf("%s: got rules %q, want %q", step.name, got, step.rules)
+		}
+	}
+
+	resp, body := callAPI("POST", "/api/rules/add", `{"url": "x"}`, session)
+	var added map[string]string
+	if err := json.Unmarshal([]byte(body), &added); err != nil || resp.StatusCode != http.StatusOK || added["id"] == "" {
+		t.Errorf("a rule without id got %d %q, want its new id", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"restfulHttpsProxy/proxy"
+	"restfulHttpsProxy/prxConfig"
+	"restfulHttpsProxy/rewriteLogic"
+	"restfulHttpsProxy/throttle"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rules, logs and throttles belong to a session. By default every client ip
+// is a session, but devices behind the same NAT share an ip, so a session can
+// also be told apart by the proxy user, a header or the port of the proxy the
+// device connects to.
+//
+// The session key is the ip, or for the other kinds "user:name",
+// "header:value" and "port:number".
+
+type sessionSource struct {
+	kind   string // "ip", "user", "header" or "port"
+	header string // for "header"
+}
+
+var sessionSources = []sessionSource{{kind: "ip"}}
+
+// Connections to these ports are the session "port:number", if "port" is
+// one of the session sources.
+var sessionPorts = make(map[string]bool)
+
+// parseSessionSources parses a comma separated list like
+// "user,header:X-Proxy-Session,ip", the first source a request has is used.
+func parseSessionSources(s string) error {
+	sessionSources = nil
+	for _, source := range strings.Split(s, ",") {
+		source = strings.TrimSpace(source)
+		switch {
+		case source == "ip" || source == "user" || source == "port":
+			sessionSources = append(sessionSources, sessionSource{kind: source})
+		case strings.HasPrefix(source, "header:") && len(source) > len("header:"):
+			sessionSources = append(sessionSources, sessionSource{
+				kind:   "header",
+				header: http.CanonicalHeaderKey(source[len("header:"):]),
+			})
+		default:
+			return errors.New("Unknown session source " + source)
+		}
+	}
+	return nil
+}
+
+// checkSessionSources refuses user sessions when the proxy does not check
+// passwords, since any client could send the name of another user and use
+// its rules. Headers cannot be checked at all, so only a warning is logged.
+func checkSessionSources(authenticated bool) error {
+	for _, source := range sessionSources {
+		switch source.kind {
+		case "user":
+			if !authenticated {
+				return errors.New("Sessions by user need -auth, otherwise any client can use the session of another user")
+			}
+		case "header":
+			log.Print("Warning: any client can set " + source.header + " and use the session of another client")
+		}
+	}
+	return nil
+}
+
+// parseSessionPorts parses a comma separated list of ports and port ranges
+// like "9001-9020,9100".
+func parseSessionPorts(s string) ([]string, error) {
+	var ports []string
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.New("Illegal session port " + part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, errors.New("Illegal session port range " + part)
+			}
+		}
+		for port := first; port <= last; port++ {
+			ports = append(ports, strconv.Itoa(port))
+			sessionPorts[strconv.Itoa(port)] = true
+		}
+	}
+	return ports, nil
+}
+
+// sessionKey returns the session of a request coming through the proxy.
+// client is nil for requests to the exposed API port.
+func sessionKey(req *http.Request, client *proxy.ClientConnProps) string {
+	ip, _ := proxy.SplitHostAndPort(req.RemoteAddr)
+	for _, source := range sessionSources {
+		switch source.kind {
+		case "ip":
+			return ip
+		case "user":
+			if client != nil && client.User != "" {
+				return "user:" + client.User
+			}
+		case "header":
+			value := req.Header.Get(source.header)
+			if value == "" && client != nil && client.ConnectHeader != nil {
+				value = client.ConnectHeader.Get(source.header)
+			}
+			if value != "" {
+				return "header:" + value
+			}
+		case "port":
+			// Requests to the API port have no client, it is never a session port.
+			if client != nil {
+				if port := rewriteLogic.ProxyPort(req); sessionPorts[port] {
+					return "port:" + port
+				}
+			}
+		}
+	}
+	return ip
+}
+
+// removeSessionHeaders keeps the session headers from reaching the server.
+func removeSessionHeaders(req *http.Request) {
+	for _, source := range sessionSources {
+		if source.kind == "header" {
+			req.Header.Del(source.header)
+		}
+	}
+}
+
+type sessionInfo struct {
+	Session     string           `json:"session"`
+	LastUsed    int64            `json:"lastUsed,omitempty"` // Unix time in milliseconds
+	Rules       int              `json:"rules"`
+	Logging     bool             `json:"logging"`
+	Throttles   []throttleInfo   `json:"throttles"`
+	Connections []connectionInfo `json:"connections"`
+}
+
+type throttleInfo struct {
+	URL         string `json:"url"`
+	Direction   string `json:"direction"` // "upload" or "download"
+	Rate        uint64 `json:"rate"`      // bits per second
+	Connections uint32 `json:"connections"`
+}
+
+type connectionInfo struct {
+	ID       uint64   `json:"id"`
+	Client   string   `json:"client"`
+	Proxy    string   `json:"proxy"`
+	User     string   `json:"user,omitempty"`
+	Opened   int64    `json:"opened"`   // Unix time in milliseconds
+	Upstream []string `json:"upstream"` // open connections to servers
+}
+
+// connectionSession returns the session of a client connection, connections
+// that did not send a request yet belong to the ip of the client.
+func connectionSession(info proxy.ConnInfo) string {
+	if info.Session != "" {
+		return info.Session
+	}
+	ip, _ := proxy.SplitHostAndPort(info.Client)
+	return ip
+}
+
+// listSessions describes every session the proxy knows of.
+func listSessions() []sessionInfo {
+	sessions := make(map[string]*sessionInfo)
+	get := func(session string) *sessionInfo {
+		if sessions[session] == nil {
+			sessions[session] = &sessionInfo{
+				Session:     session,
+				Throttles:   []throttleInfo{},
+				Connections: []connectionInfo{},
+			}
+		}
+		return sessions[session]
+	}
+	lastTimeUsed.Range(
+		func(key, val interface{}) bool {
+			get(key.(string)).LastUsed = timestamp(val.(time.Time))
+			return true
+		},
+	)
+	rewriteRules.Range(
+		func(key, val interface{}) bool {
+			rules, _ := val.(prxConfig.RewriteRules)
+			get(key.(string)).Rules = len(rules)
+			return true
+		},
+	)
+	throttledConnections.Range(
+		func(key, val interface{}) bool {
+			info := get(key.(string))
+			val.(*sync.Map).Range(
+				func(url, val interface{}) bool {
+					controller := val.(*throttle.ThrottleController)
+					rate := throttleInfo{
+						URL:         url.(string),
+						Direction:   "download",
+						Rate:        controller.Rate(),
+						Connections: controller.Connections(),
+					}
+					if strings.HasPrefix(rate.URL, "rq\n") {
+						rate.URL = rate.URL[len("rq\n"):]
+						rate.Direction = "upload"
+					}
+					info.Throttles = append(info.Throttles, rate)
+					return true
+				},
+			)
+			return true
+		},
+	)
+	for _, client := range prx.Connections() {
+		conn := client.Info()
+		info := get(connectionSession(conn))
+		info.Connections = append(info.Connections, connectionInfo{
+			ID:       conn.ID,
+			Client:   conn.Client,
+			Proxy:    conn.Proxy,
+			User:     conn.User,
+			Opened:   timestamp(conn.Opened),
+			Upstream: conn.Upstream,
+		})
+	}
+	list := []sessionInfo{}
+	for _, info := range sessions {
+		info.Logging = isLogging(info.Session)
+		sort.Slice(info.Connections, func(i, j int) bool {
+			return info.Connections[i].ID < info.Connections[j].ID
+		})
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Session < list[j].Session })
+	return list
+}
+
+// closeConnections closes the client connections of session, or only the one
+// with id if it is not 0, and returns how many were closed.
+func closeConnections(session string, id uint64) int {
+	closed := 0
+	for _, client := range prx.Connections() {
+		info := client.Info()
+		if (id != 0 && info.ID == id) || (id == 0 && connectionSession(info) == session) {
+			client.Kill()
+			closed++
+		}
+	}
+	return closed
+}
+
+// forgetSession drops the rules, throttles, fault counters and debug mode of session.
+func forgetSession(session string) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	lastTimeUsed.Delete(session)
+	old, _ := rewriteRules.Load(session)
+	rewriteRules.Delete(session)
+	oldRules, _ := old.(prxConfig.RewriteRules)
+	forgetRuleHits(oldRules)
+	forgetRules(session)
+	throttledConnections.Delete(session)
+	faultCounters.Delete(session)
+	stopDebug(session)
+}
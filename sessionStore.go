@@ -0,0 +1,168 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"restfulHttpsProxy/prxConfig"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The rules of every session are kept in a directory, one file per session,
+// so that they survive a restart of the proxy.
+
+type storedSession struct {
+	Session  string          `json:"session"`
+	IP       string          `json:"ip,omitempty"` // older name of Session
+	LastUsed int64           `json:"lastUsed"`     // Unix time in milliseconds
+	Config   json.RawMessage `json:"config"`
+}
+
+var sessionDir = "sessions"
+var sessionDirMu sync.Mutex
+
+var rulesSource sync.Map // map[string][]byte, the config JSON the rules were compiled from
+
+func sessionPath(session string) string {
+	// The session can come from the config, so it must not be able to leave the directory.
+	return filepath.Join(sessionDir, url.PathEscape(session)+".json")
+}
+
+// storeRules keeps the source of the rules of session and saves it to disk.
+func storeRules(session string, source []byte, lastUsed time.Time) {
+	rulesSource.Store(session, source)
+	saveSession(session, source, lastUsed)
+}
+
+// forgetRules removes the rules of session from disk.
+func forgetRules(session string) {
+	rulesSource.Delete(session)
+	sessionDirMu.Lock()
+	defer sessionDirMu.Unlock()
+	os.Remove(sessionPath(session))
+}
+
+func saveSession(session string, source []byte, lastUsed time.Time) {
+	sessionBytes, err := json.Marshal(storedSession{
+		Session:  session,
+		LastUsed: timestamp(lastUsed),
+		Config:   source,
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	sessionDirMu.Lock()
+	defer sessionDirMu.Unlock()
+	if _, ok := rulesSource.Load(session); !ok {
+		return // forgotten in the meantime
+	}
+	if err := os.MkdirAll(sessionDir, 0755); err != nil {
+		log.Print(err)
+		return
+	}
+	// Write to a temporary file first, so a crash never leaves half a file behind.
+	path := sessionPath(session)
+	if err := ioutil.WriteFile(path+".tmp", sessionBytes, 0600); err != nil {
+		log.Print(err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Print(err)
+	}
+}
+
+// saveLastTimesUsed writes the last time used of every client with rules to
+// disk, so that the expiration still works after a restart.
+func saveLastTimesUsed() {
+	rulesSource.Range(
+		func(key, val interface{}) bool {
+			session, _ := key.(string)
+			source, _ := val.([]byte)
+			if used, ok := lastTimeUsed.Load(session); ok {
+				saveSession(session, source, used.(time.Time))
+			}
+			return true
+		},
+	)
+}
+
+// loadSessions restores the rules saved by a previous run, sessions that
+// have expired in the meantime are removed.
+func loadSessions(expiration time.Duration) {
+	files, err := ioutil.ReadDir(sessionDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(err)
+		}
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(sessionDir, file.Name())
+		sessionBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		var stored storedSession
+		if err := json.Unmarshal(sessionBytes, &stored); err != nil {
+			log.Print(path + ": " + err.Error())
+			continue
+		}
+		if stored.Session == "" {
+			stored.Session = stored.IP
+		}
+		lastUsed := time.Unix(0, stored.LastUsed*int64(time.Millisecond))
+		if time.Now().After(lastUsed.Add(expiration)) {
+			os.Remove(path)
+			continue
+		}
+		var config prxConfig.Config
+		if err := json.Unmarshal(stored.Config, &config); err != nil {
+			log.Print(path + ": " + err.Error())
+			continue
+		}
+		// Sessions saved by older versions have rules without ids.
+		if err := assignRuleIDs(&config); err != nil {
+			log.Print(path + ": " + err.Error())
+			continue
+		}
+		newRewriteRules, err := prxConfig.Compile(config)
+		if err != nil {
+			log.Print(path + ": " + err.Error())
+			continue
+		}
+		source, err := json.Marshal(config)
+		if err != nil {
+			log.Print(path + ": " + err.Error())
+			continue
+		}
+		rewriteRules.Store(stored.Session, newRewriteRules)
+		rulesSource.Store(stored.Session, source)
+		lastTimeUsed.Store(stored.Session, lastUsed)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"restfulHttpsProxy/prxConfig"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoadSessions(t *testing.T) {
+	useTempSessionDir(t)
+	now := time.Now()
+	write := func(name string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(sessionDir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Like after a restart, only the files are left.
+	forgetAll := func(sessions ...string) {
+		for _, session := range sessions {
+			rewriteRules.Delete(session)
+			rulesSource.Delete(session)
+			lastTimeUsed.Delete(session)
+		}
+	}
+	defer func() {
+		for _, session := range []string{"saved", "10.0.0.1"} {
+			setRules(session, prxConfig.Config{})
+		}
+	}()
+
+	storeRules("saved", []byte(`{"rules": [{"id": "a", "url": "a"}]}`), now)
+	forgetAll("saved")
+	write("corrupt.json", `{"session": "corrupt", "config": {`)
+	write("old.json", `{"ip": "10.0.0.1", "lastUsed": `+strconv.FormatInt(timestamp(now), 10)+`, "config": {"rules": [{"url": "b"}, {"url": "c"}]}}`)
+	write("wrong.json", `{"session": "wrong", "lastUsed": `+strconv.FormatInt(timestamp(now), 10)+`, "config": {"rules": [{"url": "("}]}}`)
+	write("expired.json", `{"session": "expired", "lastUsed": `+strconv.FormatInt(timestamp(now.Add(-2*time.Hour)), 10)+`, "config": {"rules": [{"url": "d"}]}}`)
+
+	loadSessions(time.Hour)
+
+	if rules := getRules("saved").Rules; len(rules) != 1 || rules[0].ID != "a" || *rules[0].URL != "a" {
+		t.Errorf("got %+v for the saved session", rules)
+	}
+	if used, ok := lastTimeUsed.Load("saved"); !ok || timestamp(used.(time.Time)) != timestamp(now) {
+		t.Errorf("got last time used %v, want %v", used, now)
+	}
+	if _, ok := rewriteRules.Load("saved"); !ok {
+		t.Error("the rules of the saved session were not compiled")
+	}
+	rules := getRules("10.0.0.1").Rules
+	if len(rules) != 2 || rules[0].ID == "" || rules[1].ID == "" {
+		t.Errorf("got %+v for the session of an older version, want ids for its rules", rules)
+	}
+	for _, session := range []string{"corrupt", "wrong", "expired"} {
+		if _, ok := rewriteRules.Load(session); ok {
+			t.Errorf("the %s session was loaded", session)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sessionDir, "expired.json")); !os.IsNotExist(err) {
+		t.Error("the expired session was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(sessionDir, "corrupt.json")); err != nil {
+		t.Error("a file that cannot be read was removed")
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"restfulHttpsProxy/proxy"
+	"strings"
+	"testing"
+)
+
+func TestSessionKey(t *testing.T) {
+	defer parseSessionSources("ip")
+	sessionPorts = map[string]bool{"9001": true}
+	defer func() { sessionPorts = make(map[string]bool) }()
+	alice := &proxy.ClientConnProps{User: "alice"}
+	connected := &proxy.ClientConnProps{ConnectHeader: http.Header{"X-Session": {"tunnel"}}}
+	anonymous := &proxy.ClientConnProps{}
+	tests := []struct {
+		sources string
+		client  *proxy.ClientConnProps
+		header  string
+		port    int
+		want    string
+	}{
+		{"ip", alice, "a", 9001, "10.0.0.1"},
+		{"user,ip", alice, "", 9443, "user:alice"},
+		{"user,ip", anonymous, "", 9443, "10.0.0.1"},
+		{"user,ip", nil, "", 9443, "10.0.0.1"},
+		{"header:X-Session,ip", anonymous, "lab", 9443, "header:lab"},
+		{"header:X-Session,ip", anonymous, "", 9443, "10.0.0.1"},
+		{"header:X-Session,ip", connected, "", 9443, "header:tunnel"},
+		{"header:X-Session,ip", connected, "request", 9443, "header:request"},
+		{"header:X-Session,ip", anonymous, "a/b", 9443, "header:a/b"},
+		{"header:X-Session,ip", anonymous, "../..", 9443, "header:../.."},
+		{"port,ip", anonymous, "", 9001, "port:9001"},
+		{"port,ip", anonymous, "", 9443, "10.0.0.1"},
+		{"port,ip", nil, "", 9001, "10.0.0.1"},
+		{"header:X-Session,user,port", alice, "", 9001, "user:alice"},
+		{"header:X-Session,user,port", anonymous, "", 9001, "port:9001"},
+		{"header:X-Session,user,port", anonymous, "", 9443, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		if err := parseSessionSources(test.sources); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = "10.0.0.1:50000"
+		if test.header != "" {
+			req.Header.Set("X-Session", test.header)
+		}
+		proxyAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: test.port}
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, proxyAddr))
+		got := sessionKey(req, test.client)
+		if got != test.want {
+			t.Errorf("%s, header %q, port %d: got %q, want %q", test.sources, test.header, test.port, got, test.want)
+		}
+		// Header values can have anything, the files of the session must
+		// stay in their directories.
+		if filepath.Dir(sessionPath(got)) != filepath.Clean(sessionDir) || filepath.Dir(logPath(got)) != filepath.Clean(logDir) {
+			t.Errorf("%s: the files of session %q leave their directories", test.sources, got)
+		}
+	}
+}
+
+func TestParseSessionSources(t *testing.T) {
+	defer parseSessionSources("ip")
+	for _, sources := range []string{"mac", "header:", "ip,"} {
+		if err := parseSessionSources(sources); err == nil {
+			t.Errorf("%q: got no error", sources)
+		}
+	}
+}
+
+func TestParseSessionPorts(t *testing.T) {
+	defer func() { sessionPorts = make(map[string]bool) }()
+	tests := []struct {
+		ports string
+		want  []string
+		err   string
+	}{
+		{"9001", []string{"9001"}, ""},
+		{"9001-9003, 9100", []string{"9001", "9002", "9003", "9100"}, ""},
+		{"9003-9001", nil, "Illegal session port range 9003-9001"},
+		{"9001-", nil, "Illegal session port range 9001-"},
+		{"port", nil, "Illegal session port port"},
+		{"9001,", nil, "Illegal session port "},
+	}
+	for _, test := range tests {
+		sessionPorts = make(map[string]bool)
+		got, err := parseSessionPorts(test.ports)
+		if (err == nil) != (test.err == "") || (err != nil && !strings.HasPrefix(err.Error(), test.err)) {
+			t.Errorf("%q: got error %v, want %q", test.ports, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.ports, got, test.want)
+		}
+		for _, port := range test.want {
+			if !sessionPorts[port] {
+				t.Errorf("%q: port %s is not a session port", test.ports, port)
+			}
+		}
+	}
+}
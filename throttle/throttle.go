@@ -115,6 +115,15 @@ func (tc *ThrottleController) SetRate(rate uint64) {
 	tc.mutex.Unlock()
 }
 
+// Connections returns how many bodies are read through the controller right now.
+func (tc *ThrottleController) Connections() uint32 {
+	tc.mutex.Lock()
+	numConn := tc.numConn
+	tc.mutex.Unlock()
+
+	return numConn
+}
+
 func (tc *ThrottleController) Remove() {
 	tc.mutex.Lock()
 	tc.numConn--
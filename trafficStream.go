@@ -0,0 +1,178 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The round trips of a session can be streamed live as server-sent events,
+// every event is a roundTripLog with the bodies cut down to a preview. The
+// messages of WebSockets are sent as they pass, as webSocketEvents.
+
+// Bodies in the stream are cut to this many bytes, bodySize has the real size.
+const streamedBodyPreview = 4096
+
+// A comment is sent this often, so that closed streams are noticed.
+const streamPingPeriod = 15 * time.Second
+
+type trafficSubscriber struct {
+	events chan []byte
+}
+
+var streamsMu sync.Mutex
+var streams = make(map[string]map[*trafficSubscriber]bool) // map[session]subscribers
+
+func isStreamed(session string) bool {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	return len(streams[session]) > 0
+}
+
+// subscribeTraffic returns the event stream of session, it ends when the
+// returned body is closed.
+func subscribeTraffic(session string) io.ReadCloser {
+	sub := &trafficSubscriber{events: make(chan []byte, 100)}
+	streamsMu.Lock()
+	if streams[session] == nil {
+		streams[session] = make(map[*trafficSubscriber]bool)
+	}
+	streams[session][sub] = true
+	streamsMu.Unlock()
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer func() {
+			streamsMu.Lock()
+			delete(streams[session], sub)
+			if len(streams[session]) == 0 {
+				delete(streams, session)
+			}
+			streamsMu.Unlock()
+			writer.Close()
+		}()
+		// Sent right away, so that the client knows the stream is open.
+		if _, err := writer.Write([]byte(": streaming " + session + "\n\n")); err != nil {
+			return
+		}
+		ping := time.NewTicker(streamPingPeriod)
+		defer ping.Stop()
+		for {
+			var err error
+			select {
+			case event := <-sub.events:
+				_, err = writer.Write(event)
+			case <-ping.C:
+				_, err = writer.Write([]byte(": ping\n\n"))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return reader
+}
+
+// publishTraffic sends a round trip to the streams of session.
+func publishTraffic(session string, log roundTripLog) {
+	if !isStreamed(session) {
+		return
+	}
+	log.Req.cutBody(streamedBodyPreview)
+	log.RewrittenReq.cutBody(streamedBodyPreview)
+	log.OriginalResp.cutBody(streamedBodyPreview)
+	log.Resp.cutBody(streamedBodyPreview)
+	// They were sent one by one already, see publishWebSocketMessage.
+	log.WebSocketMessages = nil
+	publishEvent(session, "roundtrip", log)
+}
+
+// webSocketEvent is a message of the WebSocket that request opened.
+type webSocketEvent struct {
+	URL       string              `json:"url"`
+	Timestamp int64               `json:"timestamp"` // of the request, tells WebSockets with the same url apart
+	Message   webSocketMessageLog `json:"message"`
+}
+
+// publishWebSocketMessage sends a message of a WebSocket to the streams of
+// session, as soon as it passes through the proxy.
+func publishWebSocketMessage(session string, request requestLog, message webSocketMessageLog) {
+	if !isStreamed(session) {
+		return
+	}
+	message.Data = cutBody(message.Data, message.DataEncoding, streamedBodyPreview)
+	if message.Original != nil {
+		original := cutBody(*message.Original, message.DataEncoding, streamedBodyPreview)
+		message.Original = &original
+	}
+	publishEvent(session, "websocket", webSocketEvent{
+		URL:       request.URL,
+		Timestamp: request.Timestamp,
+		Message:   message,
+	})
+}
+
+// publishEvent sends an event to the streams of session. Slow streams miss
+// events instead of slowing down the proxy.
+func publishEvent(session string, event string, data interface{}) {
+	var buf bytes.Buffer
+	buf.WriteString("event: " + event + "\ndata: ")
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(data); err != nil {
+		return
+	}
+	buf.WriteString("\n") // Encode ended the data line, this ends the event
+
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	for sub := range streams[session] {
+		select {
+		case sub.events <- buf.Bytes():
+		default:
+		}
+	}
+}
+
+// cutBody keeps the first limit bytes of the body, without splitting a
+// character or a base64 quantum.
+func cutBody(body string, encoding string, limit int) string {
+	if len(body) <= limit {
+		return body
+	}
+	if encoding == "base64" {
+		return body[:limit-limit%4]
+	}
+	body = body[:limit]
+	for len(body) > 0 && !utf8.ValidString(body) {
+		body = body[:len(body)-1]
+	}
+	return body
+}
+
+func (l *requestLog) cutBody(limit int) {
+	l.Body = cutBody(l.Body, l.BodyEncoding, limit)
+}
+
+func (l *responseLog) cutBody(limit int) {
+	l.Body = cutBody(l.Body, l.BodyEncoding, limit)
+}
@@ -0,0 +1,499 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// uiPage is the web UI served at /, it only uses the API, so it can do
+// nothing the caller could not do with curl.
+// The page must not contain backquotes.
+const uiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>RestfulHttpsProxy</title>
+<style>
+body { font-family: sans-serif; margin: 0; font-size: 14px; }
+header { background: #333; color: #fff; padding: 8px 12px; display: flex; flex-wrap: wrap; gap: 12px; align-items: center; }
+header b { margin-right: 12px; }
+header a, nav a { color: inherit; }
+nav { display: flex; gap: 4px; padding: 8px 12px 0; border-bottom: 1px solid #ccc; }
+nav a { padding: 6px 12px; text-decoration: none; border: 1px solid #ccc; border-bottom: none; background: #eee; cursor: pointer; }
+nav a.active { background: #fff; font-weight: bold; }
+main { padding: 12px; }
+section { display: none; }
+section.active { display: block; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 6px; border-bottom: 1px solid #eee; vertical-align: top; }
+tr.clickable { cursor: pointer; }
+tr.clickable:hover, tr.selected { background: #eef4ff; }
+tr.disabled { color: #999; }
+label { display: block; margin: 6px 0; }
+label span { display: inline-block; width: 160px; }
+input[type=text], input[type=number] { width: 320px; }
+textarea { width: 100%; height: 160px; font-family: monospace; }
+pre { background: #f6f6f6; padding: 8px; overflow: auto; max-height: 400px; white-space: pre-wrap; word-break: break-all; }
+button { margin: 2px; }
+#message { padding: 6px 12px; }
+#message.error { background: #fdd; }
+#message.ok { background: #dfd; }
+.hint { color: #666; font-size: 12px; }
+</style>
+</head>
+<body>
+<header>
+	<b>RestfulHttpsProxy</b>
+	<span>Session <input type="text" id="session" placeholder="your own" style="width: 180px"></span>
+	<span>Token <input type="password" id="token" placeholder="if the proxy uses tokens" style="width: 180px"></span>
+	<a href="/ca.pem" download="ca.pem">Download the CA certificate</a>
+</header>
+<nav>
+	<a data-tab="rules" class="active">Rules</a>
+	<a data-tab="traffic">Traffic</a>
+	<a data-tab="sessions">Sessions</a>
+</nav>
+<div id="message"></div>
+<main>
+
+<section id="rules" class="active">
+	<button id="reloadRules">Reload</button>
+	<button id="newRule">New rule</button>
+	<button id="clearRules">Delete all rules</button>
+	<table>
+		<thead><tr><th>On</th><th>Id</th><th>Url</th><th>Does</th><th></th></tr></thead>
+		<tbody id="ruleList"></tbody>
+	</table>
+	<div id="ruleEditor" style="display: none">
+		<h3 id="ruleEditorTitle"></h3>
+		<p class="hint">Regular expressions are typed as they are, without escaping them twice. Empty fields are not used.</p>
+		<label><span>Url regex</span><input type="text" id="ruleUrl" placeholder="example\.com/api"></label>
+		<label><span>Download speed</span><input type="number" id="ruleDownloadSpeed"> bits/second</label>
+		<label><span>Upload speed</span><input type="number" id="ruleUploadSpeed"> bits/second</label>
+		<label><span>Response delay</span><input type="number" id="ruleResponseDelay"> microseconds</label>
+		<label><span>Mock status</span><input type="number" id="ruleRespondStatus"> serves this response instead of asking the server</label>
+		<label><span>Mock body</span><input type="text" id="ruleRespondBody"></label>
+		<p>Other keys of the rule, like match, rewrite and fault (see the README):</p>
+		<textarea id="ruleOther"></textarea>
+		<button id="saveRule">Save</button>
+		<button id="cancelRule">Cancel</button>
+	</div>
+</section>
+
+<section id="traffic">
+	<button id="startLogging">Start logging</button>
+	<button id="stopLogging">Stop logging</button>
+	<button id="loadLogs">Show logged</button>
+	<button id="clearLogs">Erase logged</button>
+	<button id="downloadHar">Download HAR</button>
+	<button id="live">Watch live</button>
+	<button id="clearTraffic">Clear list</button>
+	<span id="liveState" class="hint"></span>
+	<table>
+		<thead><tr><th>Time</th><th>Method</th><th>Url</th><th>Status</th><th>Rules</th><th>Size</th></tr></thead>
+		<tbody id="trafficList"></tbody>
+	</table>
+	<pre id="trafficDetail" style="display: none"></pre>
+</section>
+
+<section id="sessions">
+	<button id="reloadSessions">Reload</button>
+	<span class="hint">Needs an admin token if the proxy uses tokens. Click a session to work on it.</span>
+	<table>
+		<thead><tr><th>Session</th><th>Last used</th><th>Rules</th><th>Logging</th><th>Throttles</th><th>Connections</th><th></th></tr></thead>
+		<tbody id="sessionList"></tbody>
+	</table>
+</section>
+
+</main>
+<script>
+"use strict";
+
+var $ = function(id) { return document.getElementById(id); };
+
+$("token").value = localStorage.getItem("prxToken") || "";
+$("token").addEventListener("change", function() { localStorage.setItem("prxToken", $("token").value); });
+
+function show(text, ok) {
+	$("message").textContent = text;
+	$("message").className = ok ? "ok" : "error";
+}
+
+// api calls path with the session and token of the page and returns the response text.
+function api(path, body, params) {
+	var query = new URLSearchParams(params || {});
+	if ($("session").value) {
+		query.set("session", $("session").value);
+	}
+	var headers = {};
+	if ($("token").value) {
+		headers["X-Proxy-Token"] = $("token").value;
+	}
+	var options = { method: body === undefined ? "GET" : "POST", headers: headers };
+	if (body !== undefined) {
+		options.body = typeof body === "string" ? body : JSON.stringify(body);
+	}
+	var qs = query.toString();
+	return fetch(path + (qs ? "?" + qs : ""), options).then(function(resp) {
+		return resp.text().then(function(text) {
+			if (!resp.ok) {
+				var message = text || resp.status + " " + resp.statusText;
+				if ((resp.headers.get("Content-Type") || "").indexOf("application/json") === 0) {
+					// Rule errors tell where the problem is.
+					var problem = JSON.parse(text);
+					message = problem.path ? problem.path + ": " + problem.message : problem.message;
+				}
+				throw new Error(message);
+			}
+			return text;
+		});
+	});
+}
+
+function cell(row, text) {
+	var td = document.createElement("td");
+	td.textContent = text === undefined ? "" : text;
+	row.appendChild(td);
+	return td;
+}
+
+function button(parent, text, onClick) {
+	var b = document.createElement("button");
+	b.textContent = text;
+	b.addEventListener("click", function(e) { e.stopPropagation(); onClick(); });
+	parent.appendChild(b);
+}
+
+function time(ms) {
+	return ms ? new Date(ms).toLocaleTimeString() : "";
+}
+
+// Tabs
+
+document.querySelectorAll("nav a").forEach(function(tab) {
+	tab.addEventListener("click", function() {
+		document.querySelectorAll("nav a, section").forEach(function(e) { e.classList.remove("active"); });
+		tab.classList.add("active");
+		$(tab.dataset.tab).classList.add("active");
+		if (tab.dataset.tab === "sessions") {
+			loadSessions();
+		}
+	});
+});
+
+// Rules
+
+var rules = [];
+var editing = null; // id of the rule in the editor, "" for a new one
+
+// Keys that have their own field in the editor.
+var simpleKeys = ["url", "downloadSpeed", "uploadSpeed", "responseDelay"];
+
+function describe(rule) {
+	var does = [];
+	if (rule.downloadSpeed) does.push("download " + rule.downloadSpeed + " bit/s");
+	if (rule.uploadSpeed) does.push("upload " + rule.uploadSpeed + " bit/s");
+	if (rule.responseDelay) does.push("delay " + rule.responseDelay + " µs");
+	if (rule.respond) does.push("mock " + (rule.respond.status || 200));
+	if (rule.fault) does.push("fault");
+	if (rule.match) does.push("match");
+	if (rule.rewrite) does.push("rewrite");
+	return does.join(", ");
+}
+
+function loadRules() {
+	return api("/api/rules").then(function(text) {
+		rules = JSON.parse(text).rules;
+		var list = $("ruleList");
+		list.innerHTML = "";
+		rules.forEach(function(rule) {
+			var row = document.createElement("tr");
+			row.className = "clickable" + (rule.disabled ? " disabled" : "");
+			var on = document.createElement("input");
+			on.type = "checkbox";
+			on.checked = !rule.disabled;
+			on.addEventListener("click", function(e) {
+				e.stopPropagation();
+				api(on.checked ? "/api/rules/enable" : "/api/rules/disable", undefined, { id: rule.id })
+					.then(loadRules).catch(function(err) { show(err.message); });
+			});
+			cell(row, "").appendChild(on);
+			cell(row, rule.id);
+			cell(row, rule.url);
+			cell(row, describe(rule));
+			var actions = cell(row, "");
+			button(actions, "Delete", function() {
+				api("/api/rules/delete", undefined, { id: rule.id })
+					.then(loadRules).catch(function(err) { show(err.message); });
+			});
+			row.addEventListener("click", function() { editRule(rule); });
+			list.appendChild(row);
+		});
+	}).catch(function(err) { show(err.message); });
+}
+
+function editRule(rule) {
+	editing = rule ? rule.id : "";
+	rule = rule || {};
+	$("ruleEditorTitle").textContent = editing ? "Rule " + editing : "New rule";
+	$("ruleUrl").value = rule.url || "";
+	$("ruleDownloadSpeed").value = rule.downloadSpeed || "";
+	$("ruleUploadSpeed").value = rule.uploadSpeed || "";
+	$("ruleResponseDelay").value = rule.responseDelay || "";
+	var respond = rule.respond || {};
+	var simpleRespond = Object.keys(respond).every(function(key) { return key === "status" || key === "body"; });
+	$("ruleRespondStatus").value = simpleRespond && respond.status || "";
+	$("ruleRespondBody").value = simpleRespond && respond.body || "";
+	var other = {};
+	Object.keys(rule).forEach(function(key) {
+		if (simpleKeys.indexOf(key) === -1 && key !== "id" && key !== "disabled" && !(key === "respond" && simpleRespond)) {
+			other[key] = rule[key];
+		}
+	});
+	$("ruleOther").value = Object.keys(other).length ? JSON.stringify(other, null, 4) : "";
+	$("ruleEditor").style.display = "block";
+}
+
+function ruleFromEditor() {
+	var rule = {};
+	if ($("ruleOther").value.trim()) {
+		rule = JSON.parse($("ruleOther").value);
+	}
+	if ($("ruleUrl").value) rule.url = $("ruleUrl").value;
+	["downloadSpeed", "uploadSpeed", "responseDelay"].forEach(function(key) {
+		var value = $("rule" + key[0].toUpperCase() + key.slice(1)).value;
+		if (value) rule[key] = Number(value);
+	});
+	if ($("ruleRespondStatus").value || $("ruleRespondBody").value) {
+		rule.respond = {};
+		if ($("ruleRespondStatus").value) rule.respond.status = Number($("ruleRespondStatus").value);
+		if ($("ruleRespondBody").value) rule.respond.body = $("ruleRespondBody").value;
+	}
+	return rule;
+}
+
+// mergePatch returns the JSON Merge Patch that turns from into to.
+function mergePatch(from, to) {
+	var patch = {};
+	Object.keys(from).forEach(function(key) {
+		if (!(key in to)) patch[key] = null;
+	});
+	Object.keys(to).forEach(function(key) {
+		var a = from[key], b = to[key];
+		if (a && b && typeof a === "object" && typeof b === "object" && !Array.isArray(a) && !Array.isArray(b)) {
+			var sub = mergePatch(a, b);
+			if (Object.keys(sub).length) patch[key] = sub;
+		} else if (JSON.stringify(a) !== JSON.stringify(b)) {
+			patch[key] = b;
+		}
+	});
+	return patch;
+}
+
+$("saveRule").addEventListener("click", function() {
+	var rule;
+	try {
+		rule = ruleFromEditor();
+	} catch (err) {
+		show("The other keys are not valid JSON: " + err.message);
+		return;
+	}
+	var saved;
+	if (editing) {
+		var old = rules.filter(function(r) { return r.id === editing; })[0] || {};
+		var current = JSON.parse(JSON.stringify(old));
+		delete current.id;
+		delete current.disabled;
+		saved = api("/api/rules/update", mergePatch(current, rule), { id: editing });
+	} else {
+		saved = api("/api/rules/add", rule);
+	}
+	saved.then(function() {
+		show("Saved", true);
+		$("ruleEditor").style.display = "none";
+		loadRules();
+	}).catch(function(err) { show(err.message); });
+});
+
+$("cancelRule").addEventListener("click", function() { $("ruleEditor").style.display = "none"; });
+$("newRule").addEventListener("click", function() { editRule(null); });
+$("reloadRules").addEventListener("click", loadRules);
+$("clearRules").addEventListener("click", function() {
+	if (confirm("Delete all rules of this session?")) {
+		api("/api/rules/set", { rules: [] }).then(loadRules).catch(function(err) { show(err.message); });
+	}
+});
+$("session").addEventListener("change", function() {
+	loadRules();
+	stopLive();
+});
+
+// Traffic
+
+var traffic = [];
+
+function addTraffic(entry) {
+	traffic.push(entry);
+	var resp = entry.response && entry.response.status ? entry.response : entry.originalResponse;
+	var row = document.createElement("tr");
+	row.className = "clickable";
+	cell(row, time(entry.request.timestamp));
+	cell(row, entry.request.method);
+	cell(row, entry.request.url);
+	cell(row, resp ? resp.status : "");
+	cell(row, (entry.rules || []).join(", "));
+	cell(row, resp ? resp.bodySize : "");
+	row.addEventListener("click", function() {
+		document.querySelectorAll("#trafficList tr").forEach(function(r) { r.classList.remove("selected"); });
+		row.classList.add("selected");
+		$("trafficDetail").textContent = JSON.stringify(entry, null, 2);
+		$("trafficDetail").style.display = "block";
+	});
+	$("trafficList").appendChild(row);
+}
+
+function clearTraffic() {
+	traffic = [];
+	$("trafficList").innerHTML = "";
+	$("trafficDetail").style.display = "none";
+}
+
+var liveReader = null;
+
+// The stream is read with fetch instead of EventSource, so that the token can be sent as a header.
+function startLive() {
+	var headers = {};
+	if ($("token").value) headers["X-Proxy-Token"] = $("token").value;
+	var query = $("session").value ? "?session=" + encodeURIComponent($("session").value) : "";
+	fetch("/api/traffic/stream" + query, { headers: headers }).then(function(resp) {
+		if (!resp.ok) {
+			return resp.text().then(function(text) { throw new Error(text); });
+		}
+		liveReader = resp.body.getReader();
+		$("liveState").textContent = "watching live";
+		$("live").textContent = "Stop watching";
+		var decoder = new TextDecoder();
+		var buffer = "";
+		function read() {
+			return liveReader.read().then(function(result) {
+				if (result.done) {
+					stopLive();
+					return;
+				}
+				buffer += decoder.decode(result.value, { stream: true });
+				var events = buffer.split("\n\n");
+				buffer = events.pop();
+				events.forEach(function(event) {
+					event.split("\n").forEach(function(line) {
+						if (line.indexOf("data: ") === 0) {
+							addTraffic(JSON.parse(line.slice(6)));
+						}
+					});
+				});
+				return read();
+			});
+		}
+		return read();
+	}).catch(function(err) {
+		stopLive();
+		show(err.message);
+	});
+}
+
+function stopLive() {
+	if (liveReader) {
+		liveReader.cancel();
+		liveReader = null;
+	}
+	$("liveState").textContent = "";
+	$("live").textContent = "Watch live";
+}
+
+$("live").addEventListener("click", function() {
+	if (liveReader) stopLive(); else startLive();
+});
+$("clearTraffic").addEventListener("click", clearTraffic);
+$("startLogging").addEventListener("click", function() {
+	api("/api/logging/start").then(function(text) { show(text, true); }).catch(function(err) { show(err.message); });
+});
+$("stopLogging").addEventListener("click", function() {
+	api("/api/logging/stop").then(function(text) { show(text, true); }).catch(function(err) { show(err.message); });
+});
+$("clearLogs").addEventListener("click", function() {
+	api("/api/logging/clear").then(function(text) { show(text, true); }).catch(function(err) { show(err.message); });
+});
+$("loadLogs").addEventListener("click", function() {
+	api("/api/logging/get").then(function(text) {
+		clearTraffic();
+		JSON.parse(text).forEach(addTraffic);
+	}).catch(function(err) { show(err.message); });
+});
+$("downloadHar").addEventListener("click", function() {
+	api("/api/logging/get", undefined, { format: "har" }).then(function(text) {
+		var link = document.createElement("a");
+		link.href = URL.createObjectURL(new Blob([text], { type: "application/json" }));
+		link.download = "traffic.har";
+		link.click();
+	}).catch(function(err) { show(err.message); });
+});
+
+// Sessions
+
+function loadSessions() {
+	var session = $("session").value;
+	$("session").value = ""; // the list is not about one session
+	api("/api/sessions").then(function(text) {
+		var list = $("sessionList");
+		list.innerHTML = "";
+		JSON.parse(text).forEach(function(info) {
+			var row = document.createElement("tr");
+			row.className = "clickable" + (info.session === session ? " selected" : "");
+			cell(row, info.session);
+			cell(row, time(info.lastUsed));
+			cell(row, info.rules);
+			cell(row, info.logging ? "yes" : "");
+			cell(row, info.throttles.map(function(t) { return t.direction + " " + t.rate + " bit/s"; }).join(", "));
+			cell(row, info.connections.length);
+			var actions = cell(row, "");
+			button(actions, "Close connections", function() {
+				api("/api/sessions/close", undefined, { session: info.session })
+					.then(function(text) { show(text, true); loadSessions(); }).catch(function(err) { show(err.message); });
+			});
+			button(actions, "Kill", function() {
+				if (confirm("Drop the rules of " + info.session + " and close its connections?")) {
+					api("/api/sessions/kill", undefined, { session: info.session })
+						.then(function(text) { show(text, true); loadSessions(); }).catch(function(err) { show(err.message); });
+				}
+			});
+			row.addEventListener("click", function() {
+				$("session").value = info.session;
+				$("session").dispatchEvent(new Event("change"));
+				document.querySelector("nav a[data-tab=rules]").click();
+			});
+			list.appendChild(row);
+		});
+	}).catch(function(err) {
+		show(err.message);
+	}).then(function() {
+		$("session").value = session;
+	});
+}
+$("reloadSessions").addEventListener("click", loadSessions);
+
+loadRules();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,108 @@
+/*
+Copyright 2019 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"restfulHttpsProxy/proxy"
+	"restfulHttpsProxy/prxConfig"
+	"restfulHttpsProxy/rewriteLogic"
+	"sync/atomic"
+)
+
+// webSocketHandler applies the webSocket rules of the entries that matched
+// the request that opened a WebSocket, and records its messages.
+type webSocketHandler struct {
+	webSockets []*prxConfig.WebSocket
+	ruleLogs   []*ruleLog // of the same entries
+	recorder   *roundTripRecorder
+}
+
+func newWebSocketHandler(rules prxConfig.RewriteRules, logs []ruleLog, recorder *roundTripRecorder) *webSocketHandler {
+	h := &webSocketHandler{recorder: recorder}
+	for i := range rules {
+		if logs[i].Matched && rules[i].WebSocket != nil {
+			h.webSockets = append(h.webSockets, rules[i].WebSocket)
+			h.ruleLogs = append(h.ruleLogs, &logs[i])
+		}
+	}
+	return h
+}
+
+// toProxyMessage makes a message of a rule, those without a destination go
+// where the message the rule matched goes.
+func toProxyMessage(message prxConfig.WebSocketMessage, fromClient bool) proxy.WebSocketMessage {
+	return proxy.WebSocketMessage{
+		FromClient: message.To == "server" || (message.To == "" && fromClient),
+		Binary:     message.Binary,
+		Data:       message.Data,
+	}
+}
+
+func (h *webSocketHandler) Opened() []proxy.WebSocketMessage {
+	var messages []proxy.WebSocketMessage
+	for _, webSocket := range h.webSockets {
+		for _, open := range webSocket.Open {
+			message := toProxyMessage(open, false)
+			h.recorder.recordWebSocketMessage(message, nil, false, true)
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+func (h *webSocketHandler) Message(message proxy.WebSocketMessage) []proxy.WebSocketMessage {
+	data := message.Data
+	dropped := false
+	var injected []proxy.WebSocketMessage
+	for i, webSocket := range h.webSockets {
+		rules := webSocket.FromServer
+		if message.FromClient {
+			rules = webSocket.FromClient
+		}
+		var drop bool
+		var inject []prxConfig.WebSocketMessage
+		var matched int
+		data, drop, inject, matched = rewriteLogic.AlterWebSocketMessage(data, rules)
+		dropped = dropped || drop
+		for _, m := range inject {
+			injected = append(injected, toProxyMessage(m, message.FromClient))
+		}
+		atomic.AddInt64(&h.ruleLogs[i].WebSocket, int64(matched))
+	}
+
+	var original []byte
+	if !bytes.Equal(data, message.Data) {
+		original = message.Data
+	}
+	message.Data = data
+	h.recorder.recordWebSocketMessage(message, original, dropped, false)
+
+	var messages []proxy.WebSocketMessage
+	if !dropped {
+		messages = append(messages, message)
+	}
+	for _, m := range injected {
+		h.recorder.recordWebSocketMessage(m, nil, false, true)
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+func (h *webSocketHandler) Closed() {
+	h.recorder.finishWebSocket()
+}